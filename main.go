@@ -4,15 +4,41 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/bluesky-social/indigo/api/atproto"
@@ -23,35 +49,355 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
+	"github.com/getsentry/sentry-go"
 	"github.com/gocolly/colly"
 	"github.com/joho/godotenv"
 	encoding "github.com/mattn/go-encoding"
+	"github.com/mattn/go-mastodon"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rivo/uniseg"
 	"github.com/shopspring/decimal"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
+	"github.com/uptrace/bun/migrate"
+	"golang.org/x/image/draw"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
 )
 
 type NotifyParams struct {
-	tCli      *twitter.Client
-	dCli      *discordgo.Session
-	bCli      *xrpc.Client
-	channelID string
+	tCli        *twitter.Client
+	tV2Cli      *http.Client
+	tMediaCli   *http.Client
+	dCli        *discordgo.Session
+	bCli        *blueskyClient
+	mCli        *mastodon.Client
+	slackURL    string
+	lCli        *lineClient
+	tgCli       *telegramClient
+	dBatch      *discordBatch
+	channelID   string
+	dPlainText  bool
+	bImageEmbed bool
+	// bAdultLabels are the self-labels put on Bluesky posts about adult items.
+	bAdultLabels []string
+	// bShopHandles maps BOOTH shop names to the Bluesky handles mentioned in posts.
+	bShopHandles map[string]string
+	// delay is the pause after each published item, skipped in dry-run mode.
+	delay time.Duration
+	// maxItemAge suppresses new-item posts for items published longer ago than this.
+	maxItemAge time.Duration
+	// Hashtag blocks appended to posts per channel. Discord gets none.
+	tHashtags string
+	bHashtags string
+	mHashtags string
+	// queue, when set, stores failed notifications for drainNotifyQueue to retry.
+	queue bun.IDB
+	// dryRun logs what would be posted instead of posting it and skips DB writes.
+	dryRun bool
+	// filter decides which scraped items are skipped.
+	filter ItemFilter
+	// templates override the built-in new-item and update posts.
+	templates PostTemplates
+	// scrape is how item pages are fetched from BOOTH.
+	scrape ScrapeOptions
+	// adultWarning prefixes posts about adult items with adultWarningLabel.
+	adultWarning bool
+	// notifyPriceIncreases announces price rises; when false only drops are posted.
+	notifyPriceIncreases bool
+}
+
+// withoutChannels returns p's settings with every channel and the retry queue
+// removed, so nothing published through it leaves the process.
+func (p NotifyParams) withoutChannels() NotifyParams {
+	p.tCli, p.tV2Cli, p.tMediaCli = nil, nil, nil
+	p.dCli, p.bCli, p.mCli = nil, nil, nil
+	p.slackURL = ""
+	p.lCli, p.tgCli = nil, nil
+	p.dBatch = nil
+	p.queue = nil
+	return p
 }
 
 type Item struct {
 	bun.BaseModel `bun:"table:items,alias:i"`
 
+	ID              int64        `bun:"id,pk,autoincrement"`
+	Name            string       `bun:"name,notnull"`
+	Category        string       `bun:"category,notnull,default:''"`
+	Price           string       `bun:"price,type:numeric,notnull"`
+	URL             string       `bun:"url,notnull,unique"`
+	ImageURL        string       `bun:"image_url,notnull"`
+	Currency        string       `bun:"currency,notnull,default:'JPY'"`
+	ShopName        string       `bun:"-"`
+	ShopURL         string       `bun:"shop_url,notnull,default:''"`
+	Description     string       `bun:"description,notnull,default:''"`
+	Stock           bool         `bun:"stock,notnull"`
+	Adult           bool         `bun:"adult,notnull,default:false"`
+	NotifiedTwitter *bool        `bun:"notified_twitter"`
+	NotifiedDiscord *bool        `bun:"notified_discord"`
+	NotifiedBluesky *bool        `bun:"notified_bluesky"`
+	PublishedAt     time.Time    `bun:"published_at,nullzero"`
+	Tags            []string     `bun:"-"`
+	Images          []string     `bun:"-"`
+	Query           *SearchQuery `bun:"-"`
+	CreatedAt       time.Time    `bun:"created_at,notnull,default:current_timestamp"`
+	UpdatedAt       time.Time    `bun:"updated_at,notnull,default:current_timestamp"`
+}
+
+type PriceHistory struct {
+	bun.BaseModel `bun:"table:price_histories,alias:ph"`
+
+	ID         int64     `bun:"id,pk,autoincrement"`
+	ItemID     int64     `bun:"item_id,notnull"`
+	Price      string    `bun:"price,type:numeric,notnull"`
+	RecordedAt time.Time `bun:"recorded_at,notnull,default:current_timestamp"`
+}
+
+type Run struct {
+	bun.BaseModel `bun:"table:runs,alias:r"`
+
+	ID         int64     `bun:"id,pk,autoincrement"`
+	StartedAt  time.Time `bun:"started_at,notnull"`
+	FinishedAt time.Time `bun:"finished_at,notnull"`
+}
+
+// NotifyQueueEntry is a failed notification waiting to be retried on a later run.
+type NotifyQueueEntry struct {
+	bun.BaseModel `bun:"table:notify_queue,alias:nq"`
+
+	ID          int64     `bun:"id,pk,autoincrement"`
+	Channel     string    `bun:"channel,notnull"`
+	ItemID      int64     `bun:"item_id,notnull"`
+	Payload     string    `bun:"payload,notnull"`
+	Attempts    int       `bun:"attempts,notnull"`
+	NextRetryAt time.Time `bun:"next_retry_at,notnull"`
+	CreatedAt   time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// Digest records each posted digest so the next one covers only newer items.
+type Digest struct {
+	bun.BaseModel `bun:"table:digests,alias:dg"`
+
 	ID        int64     `bun:"id,pk,autoincrement"`
-	Name      string    `bun:"name,notnull"`
-	Category  string    `bun:"category,notnull,default:''"`
-	Price     string    `bun:"price,type:numeric,notnull"`
-	URL       string    `bun:"url,notnull"`
-	ImageURL  string    `bun:"image_url,notnull"`
-	ShopName  string    `bun:"-"`
-	CreatedAt time.Time `bun:"created_at,notnull,default:current_timestamp"`
-	UpdatedAt time.Time `bun:"updated_at,notnull,default:current_timestamp"`
+	PostedAt  time.Time `bun:"posted_at,notnull"`
+	ItemCount int       `bun:"item_count,notnull"`
+}
+
+// BlueskySession caches Bluesky session tokens between runs so that every
+// invocation does not have to create a new session.
+type BlueskySession struct {
+	bun.BaseModel `bun:"table:bluesky_sessions,alias:bs"`
+
+	Identifier string    `bun:"identifier,pk"`
+	Did        string    `bun:"did,notnull"`
+	Handle     string    `bun:"handle,notnull"`
+	AccessJwt  string    `bun:"access_jwt,notnull"`
+	RefreshJwt string    `bun:"refresh_jwt,notnull"`
+	ExpiresAt  time.Time `bun:"expires_at,notnull"`
+	UpdatedAt  time.Time `bun:"updated_at,notnull,default:current_timestamp"`
+}
+
+// ScrapeOptions controls how getItems crawls BOOTH.
+type ScrapeOptions struct {
+	MaxPages   int
+	RetryCount int
+	UserAgent  string
+	// Delay is the minimum wait between requests to BOOTH.
+	Delay time.Duration
+	// RandomDelay is the upper bound of an extra random wait added to Delay.
+	RandomDelay time.Duration
+	// Locale is the BOOTH language path segment, e.g. "ja" or "en".
+	Locale string
+	// BaseURL overrides the BOOTH origin, e.g. to point at a local fixture server.
+	BaseURL string
+	// Transport, when set, replaces colly's default HTTP transport.
+	Transport http.RoundTripper
+	// Concurrency is how many queries are scraped at once.
+	Concurrency int
+	// SortOrder is used for queries that don't set their own sort.
+	SortOrder string
+	// NewArrivalOnly limits results to BOOTH's new arrivals.
+	NewArrivalOnly bool
+	// Detail fetches each new item's detail data for tags, images and the full description.
+	Detail bool
+	// DebugHTMLDir, when set, receives the raw HTML of item cards whose name or price is empty.
+	DebugHTMLDir string
+	// ShopURL, when set, scrapes this shop's item listing instead of BOOTH's search.
+	ShopURL string
+	// Selectors locate item fields in the search results; the zero value uses defaultSelectors.
+	Selectors Selectors
+}
+
+// Selectors are the CSS selectors used to parse BOOTH's search results. All but
+// Card are relative to an item card, and PriceAttr is an attribute of the card.
+type Selectors struct {
+	Card      string `json:"card"`
+	Category  string `json:"category"`
+	Title     string `json:"title"`
+	Link      string `json:"link"`
+	ShopName  string `json:"shop_name"`
+	ShopLink  string `json:"shop_link"`
+	Image     string `json:"image"`
+	PriceAttr string `json:"price_attr"`
+	Price     string `json:"price"`
+	SoldOut   string `json:"sold_out"`
+	Adult     string `json:"adult"`
+}
+
+var defaultSelectors = Selectors{
+	Card:      "li.item-card",
+	Category:  "div.item-card__category",
+	Title:     "div.item-card__title",
+	Link:      "div.item-card__title a",
+	ShopName:  "div.item-card__shop-name",
+	ShopLink:  "div.item-card__shop-name a",
+	Image:     "div img",
+	PriceAttr: "data-product-price",
+	Price:     "div.price",
+	SoldOut:   "div.item-card__sold-out, .badge--sold-out",
+	Adult:     ".badge--adult, .item-card__adult",
+}
+
+// ItemFilter decides which scraped items are skipped before any insert or notify.
+type ItemFilter struct {
+	MinPrice        *decimal.Decimal
+	ExcludeKeywords []string
+	// CategoryAllowlist, when non-empty, keeps only items in one of these categories.
+	CategoryAllowlist []string
+	ShopBlocklist     []string
+	// ShopAllowlist, when non-empty, keeps only items from one of these shops.
+	ShopAllowlist []string
+	SkipAdult     bool
+}
+
+type SearchQuery struct {
+	Keyword   string `json:"keyword"`
+	Category  string `json:"category"`
+	Type      string `json:"type"`
+	InStock   bool   `json:"in_stock"`
+	SortOrder string `json:"sort"`
+}
+
+var defaultSearchQuery = SearchQuery{
+	Keyword:  "東方Project",
+	Category: "音楽",
+	Type:     "digital",
+	InStock:  true,
+}
+
+// Config is every setting, read once in main from the environment (after
+// CONFIG_FILE is applied) and the command-line flags.
+type Config struct {
+	DryRun      bool
+	HTTPTimeout time.Duration
+	DatabaseDSN string
+	// Migrate is the -migrate direction; AutoMigrate applies pending migrations on startup.
+	Migrate     string
+	AutoMigrate bool
+	MetricsAddr string
+	// WebhookAddr, when set, serves POST /trigger to run a pass on demand;
+	// requests must carry WebhookSecret in the X-Webhook-Secret header.
+	WebhookAddr   string
+	WebhookSecret string
+	Sentry        SentryConfig
+	// Seed stores the scraped items as a baseline without notifying.
+	Seed          bool
+	WatchInterval time.Duration
+	TestNotify    bool
+	// Backfill is like Seed but scrapes every page and can be re-run.
+	Backfill bool
+	// DigestMode replaces per-item posts with one roundup of new items every DigestInterval.
+	DigestMode     bool
+	DigestInterval time.Duration
+
+	Scrape    ScrapeOptions
+	Queries   []SearchQuery
+	Filter    ItemFilter
+	Templates PostTemplates
+	// AdultWarning marks posts about adult items with adultWarningLabel.
+	AdultWarning bool
+	// NotifyPriceIncreases announces updates whose price went up; when false only price drops are posted.
+	NotifyPriceIncreases bool
+	// MaxItemsPerRun caps how many new items are handled per run; the newer
+	// ones are left uninserted for a later run. Zero means no cap.
+	MaxItemsPerRun int
+	// OutputJSON is where each pass writes its processed items as JSON; "-" is stdout.
+	OutputJSON string
+	// NotifyDelay is the pause after each published item.
+	NotifyDelay time.Duration
+	MaxItemAge  time.Duration
+
+	Twitter  TwitterConfig
+	Discord  DiscordConfig
+	Bluesky  BlueskyConfig
+	Mastodon MastodonConfig
+	Slack    SlackConfig
+	Line     LineConfig
+	Telegram TelegramConfig
+}
+
+type SentryConfig struct {
+	DSN         string
+	Environment string
+}
+
+type TwitterConfig struct {
+	ConsumerKey       string
+	ConsumerSecret    string
+	AccessToken       string
+	AccessTokenSecret string
+	APIV2             bool
+	Hashtags          string
+	// Enabled mutes the channel when false without removing its credentials.
+	Enabled bool
+}
+
+type DiscordConfig struct {
+	BotToken  string
+	ChannelID string
+	GuildID   string
+	PlainText bool
+	Batch     bool
+	Enabled   bool
+}
+
+type BlueskyConfig struct {
+	Handle     string
+	Password   string
+	PDSHost    string
+	ImageEmbed bool
+	Hashtags   string
+	RetryCount int
+	Enabled    bool
+	// AdultLabels are the self-labels put on posts about adult items.
+	AdultLabels []string
+	// ShopHandles maps BOOTH shop names to the shops' Bluesky handles.
+	ShopHandles map[string]string
+}
+
+type MastodonConfig struct {
+	Server      string
+	AccessToken string
+	Hashtags    string
+}
+
+type SlackConfig struct {
+	WebhookURL string
+}
+
+type LineConfig struct {
+	ChannelToken string
+	To           string
+}
+
+type TelegramConfig struct {
+	BotToken string
+	ChatID   string
 }
 
 func envLoad() {
@@ -63,310 +409,3588 @@ func envLoad() {
 	}
 	if os.Getenv("GO_ENV") != "production" {
 		fileName := fmt.Sprintf(".env.%s", os.Getenv("GO_ENV"))
-		if err := godotenv.Load(fileName); err != nil {
-			log.Fatal("Error loading .env file")
+		// A missing file is fine, e.g. in tests; settings then come from the environment alone.
+		if err := godotenv.Load(fileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Error loading .env file", "file", fileName, "error", err)
+			os.Exit(1)
 		}
 	}
 }
 
-func mustGetenv(k string) string {
-	v := os.Getenv(k)
-	if v == "" {
-		log.Fatalf("Warning: %s environment variable not set.", k)
-	}
-	return v
+// Flags holds the command-line overrides. Each flag defaults to its env var.
+type Flags struct {
+	DryRun   bool
+	Debug    bool
+	LogLevel string
+	MaxPages int
+	// Query, when set, replaces SEARCH_QUERIES with the default query using this keyword.
+	Query string
+	// TestNotify posts a canned message to every configured channel instead of scraping.
+	TestNotify bool
+	// Backfill imports every listed item without notifying.
+	Backfill bool
+	// Migrate is "up" or "down" to apply or roll back migrations and exit.
+	Migrate string
 }
 
-func setupTwitterClient() *twitter.Client {
-	var (
-		consumerKey       = os.Getenv("TWITTER_CONSUMER_KEY")
-		consumerSecret    = os.Getenv("TWITTER_CONSUMER_SECRET")
-		accessToken       = os.Getenv("TWITTER_ACCESS_TOKEN")
-		accessTokenSecret = os.Getenv("TWITTER_ACCESS_TOKEN_SECRET")
-	)
-	if consumerKey == "" || consumerSecret == "" || accessToken == "" || accessTokenSecret == "" {
+func parseFlags() Flags {
+	var f Flags
+	flag.BoolVar(&f.DryRun, "dry-run", getenvBool("DRY_RUN", false), "log notifications instead of sending them (DRY_RUN)")
+	flag.BoolVar(&f.Debug, "debug", getenvBool("DEBUG", false), "enable debug logging (DEBUG)")
+	flag.StringVar(&f.LogLevel, "log-level", os.Getenv("LOG_LEVEL"), "log level: debug, info, warn or error (LOG_LEVEL)")
+	flag.IntVar(&f.MaxPages, "max-pages", getenvInt("MAX_PAGES", defaultMaxPages), "maximum result pages per query (MAX_PAGES)")
+	flag.StringVar(&f.Query, "query", "", "search only this keyword instead of SEARCH_QUERIES")
+	flag.BoolVar(&f.Backfill, "backfill", getenvBool("BACKFILL", false), "import all listed items without notifying, skipping known ones (BACKFILL)")
+	flag.StringVar(&f.Migrate, "migrate", "", "apply (up) or roll back (down) database migrations and exit")
+	flag.BoolVar(&f.TestNotify, "test-notify", getenvBool("TEST_NOTIFY", false), "post a test message to every configured channel and exit (TEST_NOTIFY)")
+	flag.Parse()
+	return f
+}
+
+// loadConfigFile reads a YAML file whose keys are env var names and sets each
+// one that the environment leaves empty, so env vars override file values.
+// Lists of strings become comma-separated values; other nested values, such as
+// SEARCH_QUERIES, are stored as JSON.
+func loadConfigFile(name string) error {
+	if name == "" {
 		return nil
 	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return err
+	}
 
-	// Twitter client setup
-	config := oauth1.NewConfig(consumerKey, consumerSecret)
-	token := oauth1.NewToken(accessToken, accessTokenSecret)
-	httpClient := config.Client(oauth1.NoContext, token)
+	for k, v := range values {
+		if os.Getenv(k) != "" {
+			continue
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if err := os.Setenv(k, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return twitter.NewClient(httpClient)
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				b, err := json.Marshal(v)
+				return string(b), err
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, ","), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
 }
 
-func setupDiscord() *discordgo.Session {
-	token := os.Getenv("DISCORD_BOT_TOKEN")
-	if token == "" {
-		return nil
+func setupLogger(f Flags) {
+	level := slog.LevelInfo
+	if f.Debug {
+		level = slog.LevelDebug
+	}
+	if v := f.LogLevel; v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			slog.Warn("invalid log level, using default", "value", v)
+		}
 	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
 
-	discord, err := discordgo.New("Bot " + token)
+func getenvInt(k string, def int) int {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		log.Fatalf("error discord setup: %s", err)
+		slog.Warn("invalid integer env, using default", "key", k, "value", v, "default", def)
+		return def
 	}
-	return discord
+	return n
 }
 
-func setupBluesky(ctx context.Context) *xrpc.Client {
-	cli := &xrpc.Client{
-		Host: "https://bsky.social",
+func getenvDefault(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
 	}
+	return def
+}
 
-	identifier := os.Getenv("BLUESKY_HANDLE")
-	password := os.Getenv("BLUESKY_PASSWORD")
-	input := &atproto.ServerCreateSession_Input{
-		Identifier: identifier,
-		Password:   password,
+// getenvList splits a comma-separated env var, dropping blank entries.
+func getenvList(k string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(k), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
-	output, err := atproto.ServerCreateSession(ctx, cli, input)
+	return list
+}
+
+func getenvBool(k string, def bool) bool {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
 	if err != nil {
-		log.Fatal(err)
+		slog.Warn("invalid boolean env, using default", "key", k, "value", v, "default", def)
+		return def
 	}
-	cli.Auth = &xrpc.AuthInfo{
-		AccessJwt:  output.AccessJwt,
-		RefreshJwt: output.RefreshJwt,
-		Handle:     output.Handle,
-		Did:        output.Did,
+	return b
+}
+
+func getenvDuration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("invalid duration env, using default", "key", k, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+func loadConfig(flags Flags) (Config, error) {
+	cfg := Config{
+		DryRun:        flags.DryRun,
+		HTTPTimeout:   getenvDuration("HTTP_TIMEOUT", defaultHTTPTimeout),
+		DatabaseDSN:   os.Getenv("DATABASE_DSN"),
+		Migrate:       flags.Migrate,
+		AutoMigrate:   getenvBool("AUTO_MIGRATE", false),
+		MetricsAddr:   os.Getenv("METRICS_ADDR"),
+		WebhookAddr:   os.Getenv("WEBHOOK_ADDR"),
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+		Sentry: SentryConfig{
+			DSN:         os.Getenv("SENTRY_DSN"),
+			Environment: os.Getenv("SENTRY_ENVIRONMENT"),
+		},
+		Seed:           getenvBool("SEED", false),
+		Backfill:       flags.Backfill,
+		WatchInterval:  getenvDuration("WATCH_INTERVAL", 0),
+		TestNotify:     flags.TestNotify,
+		DigestMode:     getenvBool("DIGEST_MODE", false),
+		DigestInterval: getenvDuration("DIGEST_INTERVAL", defaultDigestInterval),
+		Scrape: ScrapeOptions{
+			MaxPages:       flags.MaxPages,
+			RetryCount:     getenvInt("RETRY_COUNT", defaultRetryCount),
+			UserAgent:      getenvDefault("BOOTH_USER_AGENT", defaultBoothUserAgent),
+			Delay:          getenvDuration("BOOTH_REQUEST_DELAY", defaultBoothRequestDelay),
+			RandomDelay:    getenvDuration("BOOTH_REQUEST_RANDOM_DELAY", defaultBoothRequestRandomDelay),
+			Locale:         loadBoothLocale(),
+			Concurrency:    getenvInt("SCRAPE_CONCURRENCY", defaultScrapeConcurrency),
+			SortOrder:      loadSortOrder(),
+			NewArrivalOnly: getenvBool("NEW_ARRIVAL_ONLY", true),
+			Detail:         getenvBool("SCRAPE_DETAIL", false),
+			DebugHTMLDir:   os.Getenv("DEBUG_SAVE_HTML"),
+		},
+		MaxItemsPerRun:       getenvInt("MAX_ITEMS_PER_RUN", 0),
+		NotifyPriceIncreases: getenvBool("NOTIFY_PRICE_INCREASES", true),
+		OutputJSON:           os.Getenv("OUTPUT_JSON"),
+		NotifyDelay:          getenvDuration("NOTIFY_DELAY", defaultNotifyDelay),
+		MaxItemAge:           getenvDuration("MAX_ITEM_AGE", 0),
+		Twitter: TwitterConfig{
+			ConsumerKey:       os.Getenv("TWITTER_CONSUMER_KEY"),
+			ConsumerSecret:    os.Getenv("TWITTER_CONSUMER_SECRET"),
+			AccessToken:       os.Getenv("TWITTER_ACCESS_TOKEN"),
+			AccessTokenSecret: os.Getenv("TWITTER_ACCESS_TOKEN_SECRET"),
+			APIV2:             getenvBool("TWITTER_API_V2", false),
+			Hashtags:          getenvDefault("TWITTER_HASHTAGS", defaultHashtags),
+			Enabled:           getenvBool("ENABLE_TWITTER", true),
+		},
+		Discord: DiscordConfig{
+			BotToken:  os.Getenv("DISCORD_BOT_TOKEN"),
+			ChannelID: os.Getenv("DISCORD_CHANNEL_ID"),
+			GuildID:   os.Getenv("DISCORD_GUILD_ID"),
+			PlainText: getenvBool("DISCORD_PLAIN_TEXT", false),
+			Batch:     getenvBool("DISCORD_BATCH", false),
+			Enabled:   getenvBool("ENABLE_DISCORD", true),
+		},
+		Bluesky: BlueskyConfig{
+			Handle:      os.Getenv("BLUESKY_HANDLE"),
+			Password:    os.Getenv("BLUESKY_PASSWORD"),
+			PDSHost:     getenvDefault("BLUESKY_PDS_HOST", defaultBlueskyHost),
+			ImageEmbed:  getenvBool("BLUESKY_IMAGE_EMBED", false),
+			Hashtags:    getenvDefault("BLUESKY_HASHTAGS", defaultHashtags),
+			RetryCount:  getenvInt("BLUESKY_RETRY_COUNT", defaultRetryCount),
+			Enabled:     getenvBool("ENABLE_BLUESKY", true),
+			AdultLabels: getenvList("BLUESKY_ADULT_LABELS"),
+		},
+		Mastodon: MastodonConfig{
+			Server:      os.Getenv("MASTODON_SERVER"),
+			AccessToken: os.Getenv("MASTODON_ACCESS_TOKEN"),
+			Hashtags:    getenvDefault("MASTODON_HASHTAGS", defaultHashtags),
+		},
+		Slack: SlackConfig{
+			WebhookURL: os.Getenv("SLACK_WEBHOOK_URL"),
+		},
+		Line: LineConfig{
+			ChannelToken: os.Getenv("LINE_CHANNEL_TOKEN"),
+			To:           os.Getenv("LINE_TO"),
+		},
+		Telegram: TelegramConfig{
+			BotToken: os.Getenv("TELEGRAM_BOT_TOKEN"),
+			ChatID:   os.Getenv("TELEGRAM_CHAT_ID"),
+		},
 	}
 
-	return cli
+	if cfg.Migrate != "" && cfg.Migrate != "up" && cfg.Migrate != "down" {
+		return cfg, fmt.Errorf("invalid -migrate %q: must be up or down", cfg.Migrate)
+	}
+	if cfg.WebhookAddr != "" && cfg.WebhookSecret == "" {
+		return cfg, errors.New("WEBHOOK_SECRET must be set when WEBHOOK_ADDR is")
+	}
+	var err error
+	cfg.Queries, err = loadSearchQueries()
+	if err != nil {
+		return cfg, err
+	}
+	if flags.Query != "" {
+		q := defaultSearchQuery
+		q.Keyword = flags.Query
+		cfg.Queries = []SearchQuery{q}
+	}
+	if v := os.Getenv("BLUESKY_SHOP_HANDLES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.Bluesky.ShopHandles); err != nil {
+			return cfg, fmt.Errorf("invalid BLUESKY_SHOP_HANDLES: %w", err)
+		}
+	}
+	switch v := os.Getenv("ADULT_ITEMS"); v {
+	case "", adultItemsSkip, adultItemsWarn:
+		cfg.AdultWarning = v == adultItemsWarn
+	default:
+		return cfg, fmt.Errorf("invalid ADULT_ITEMS %q: must be %q or %q", v, adultItemsSkip, adultItemsWarn)
+	}
+	if len(cfg.Bluesky.AdultLabels) == 0 {
+		cfg.Bluesky.AdultLabels = []string{defaultBlueskyAdultLabel}
+	}
+	for _, l := range cfg.Bluesky.AdultLabels {
+		if !slices.Contains(blueskySelfLabels, l) {
+			return cfg, fmt.Errorf("invalid BLUESKY_ADULT_LABELS: unknown label %q", l)
+		}
+	}
+	if v := os.Getenv("SHOP_URL"); v != "" {
+		cfg.Scrape.ShopURL, err = parseShopURL(v)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Scrape.Selectors, err = loadSelectors()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Filter, err = loadItemFilter()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Templates, err = loadPostTemplates()
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
 }
 
-func setupDB(ctx context.Context) *bun.DB {
-	dsn := mustGetenv("DATABASE_DSN")
+func loadSearchQueries() ([]SearchQuery, error) {
+	v := os.Getenv("SEARCH_QUERIES")
+	if v == "" {
+		return []SearchQuery{defaultSearchQuery}, nil
+	}
 
-	// Database
-	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
-	db := bun.NewDB(sqldb, pgdialect.New())
+	var queries []SearchQuery
+	if err := json.Unmarshal([]byte(v), &queries); err != nil {
+		return nil, fmt.Errorf("invalid SEARCH_QUERIES: %w", err)
+	}
+	for _, q := range queries {
+		if q.SortOrder != "" && !slices.Contains(boothSortOrders, q.SortOrder) {
+			return nil, fmt.Errorf("invalid SEARCH_QUERIES: unknown sort %q", q.SortOrder)
+		}
+	}
+	return queries, nil
+}
 
-	var v string
-	if err := db.NewSelect().ColumnExpr("version()").Scan(ctx, &v); err != nil {
-		panic(err)
+// parseShopURL checks that v is a BOOTH shop, such as https://example.booth.pm,
+// and returns its origin.
+func parseShopURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Host, ".booth.pm") || u.Host == "www.booth.pm" {
+		return "", fmt.Errorf("invalid SHOP_URL %q: must be a https://<shop>.booth.pm URL", v)
 	}
-	log.Println(v)
+	return u.Scheme + "://" + u.Host, nil
+}
 
-	return db
+// loadSelectors applies BOOTH_SELECTORS, a JSON object of Selectors fields, on
+// top of defaultSelectors so only the selectors BOOTH changed need to be set.
+func loadSelectors() (Selectors, error) {
+	sel := defaultSelectors
+	v := os.Getenv("BOOTH_SELECTORS")
+	if v == "" {
+		return sel, nil
+	}
+	if err := json.Unmarshal([]byte(v), &sel); err != nil {
+		return sel, fmt.Errorf("invalid BOOTH_SELECTORS: %w", err)
+	}
+	return sel, nil
 }
 
-var (
-	debug  bool
-	_      bun.BeforeAppendModelHook = (*Item)(nil)
-	tagRe                            = regexp.MustCompile(`\B#\S+`)
-	linkRe                           = regexp.MustCompile(`https?://\S+`)
-)
+// blueskySelfLabels lists the content warning labels Bluesky accepts as self-labels.
+var blueskySelfLabels = []string{"sexual", "nudity", "porn", "graphic-media"}
 
-func init() {
-	envLoad()
+// boothSortOrders lists the sort values BOOTH's search accepts.
+var boothSortOrders = []string{"new", "popularity", "wish_lists", "price_asc", "price_desc"}
 
-	time.Local = time.FixedZone("Local", 9*60*60)
+func loadSortOrder() string {
+	v := getenvDefault("SORT_ORDER", defaultSortOrder)
+	if !slices.Contains(boothSortOrders, v) {
+		slog.Warn("unknown SORT_ORDER, using default", "value", v, "default", defaultSortOrder)
+		return defaultSortOrder
+	}
+	return v
 }
 
-func main() {
-	log.Println("touhou booth notify start!")
-	debug = os.Getenv("DEBUG") != ""
-
-	ctx := context.Background()
+// boothLocales lists the BOOTH_LOCALE values BOOTH serves listings for.
+var boothLocales = []string{"ja", "en"}
 
-	db := setupDB(ctx)
-	// Twitter client
-	tClient := setupTwitterClient()
-	// Discord client
-	discord := setupDiscord()
-	err := discord.Open()
-	if err != nil {
-		log.Fatalf("error opening connection: %s", err)
+func loadBoothLocale() string {
+	v := getenvDefault("BOOTH_LOCALE", defaultBoothLocale)
+	if !slices.Contains(boothLocales, v) {
+		slog.Warn("unknown BOOTH_LOCALE, using default", "value", v, "default", defaultBoothLocale)
+		return defaultBoothLocale
 	}
-	defer discord.Close()
-	// Bluesky client
-	bClient := setupBluesky(ctx)
+	return v
+}
 
-	params := NotifyParams{
-		tCli:      tClient,
-		dCli:      discord,
-		bCli:      bClient,
-		channelID: os.Getenv("DISCORD_CHANNEL_ID"),
+func loadItemFilter() (ItemFilter, error) {
+	var f ItemFilter
+	if v := os.Getenv("MIN_PRICE"); v != "" {
+		minPrice, err := decimal.NewFromString(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid MIN_PRICE: %w", err)
+		}
+		f.MinPrice = &minPrice
 	}
+	f.ExcludeKeywords = getenvList("EXCLUDE_KEYWORDS")
+	f.CategoryAllowlist = getenvList("CATEGORY_ALLOWLIST")
+	f.ShopBlocklist = getenvList("SHOP_BLOCKLIST")
+	f.ShopAllowlist = getenvList("SHOP_ALLOWLIST")
+	f.SkipAdult = os.Getenv("ADULT_ITEMS") == adultItemsSkip
+	return f, nil
+}
 
-	items, err := getItems()
-	if err != nil {
-		log.Fatalf("getItems error: %s", err)
+// validateItem reports the first field a notification needs that the scrape
+// left empty, which usually means BOOTH's markup changed.
+func validateItem(item *Item) error {
+	switch {
+	case strings.TrimSpace(item.Name) == "":
+		return errors.New("item has no name")
+	case item.URL == "":
+		return errors.New("item has no URL")
+	case item.Price == "":
+		return errors.New("item has no price")
+	case item.ImageURL == "":
+		return errors.New("item has no image URL")
 	}
+	return nil
+}
 
-	for i := len(items) - 1; i >= 0; i-- {
-		if debug {
-			if i == 0 {
-				run(ctx, db, items[i], params)
-			}
-		} else {
-			run(ctx, db, items[i], params)
+// skipReason returns why item should be skipped, or an empty string to keep it.
+func (f ItemFilter) skipReason(item *Item) string {
+	if f.MinPrice != nil {
+		price, err := decimal.NewFromString(item.Price)
+		if err == nil && price.LessThan(*f.MinPrice) {
+			return "below minimum price"
 		}
 	}
+	if containsAny(item.Name, f.ExcludeKeywords) || containsAny(item.ShopName, f.ExcludeKeywords) {
+		return "excluded keyword"
+	}
+	if len(f.CategoryAllowlist) > 0 && !containsFold(f.CategoryAllowlist, item.Category) {
+		return "category not allowed"
+	}
+	if containsFold(f.ShopBlocklist, item.ShopName) {
+		return "shop blocked"
+	}
+	if len(f.ShopAllowlist) > 0 && !containsFold(f.ShopAllowlist, item.ShopName) {
+		return "shop not allowed"
+	}
+	if f.SkipAdult && item.Adult {
+		return "adult item"
+	}
+	return ""
+}
 
-	log.Println("touhou booth notify successfully completed!")
+// containsFold reports whether list has s, ignoring case and surrounding whitespace.
+func containsFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	return slices.ContainsFunc(list, func(v string) bool {
+		return strings.EqualFold(v, s)
+	})
 }
 
-func (i *Item) BeforeAppendModel(_ context.Context, query bun.Query) error {
-	switch query.(type) {
-	case *bun.InsertQuery:
-		now := time.Now()
-		i.CreatedAt = now
-		i.UpdatedAt = now
-	case *bun.UpdateQuery:
-		i.UpdatedAt = time.Now()
+func containsAny(s string, keywords []string) bool {
+	for _, k := range keywords {
+		if strings.Contains(s, k) {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
-func getItems() ([]*Item, error) {
-	baseURL := "https://booth.pm/ja/browse/%E9%9F%B3%E6%A5%BD?in_stock=true&new_arrival=true&q=%E6%9D%B1%E6%96%B9Project&sort=new&type=digital"
-	c := colly.NewCollector()
+func setupTwitterHTTPClient(cfg TwitterConfig) *http.Client {
+	if cfg.ConsumerKey == "" || cfg.ConsumerSecret == "" || cfg.AccessToken == "" || cfg.AccessTokenSecret == "" {
+		return nil
+	}
+
+	// Twitter client setup
+	config := oauth1.NewConfig(cfg.ConsumerKey, cfg.ConsumerSecret)
+	token := oauth1.NewToken(cfg.AccessToken, cfg.AccessTokenSecret)
 
-	var items []*Item
-	c.OnHTML("li.item-card", func(e *colly.HTMLElement) {
-		category := e.DOM.Find("div.item-card__category").Text()
-		name := e.DOM.Find("div.item-card__title").Text()
-		shopName := e.DOM.Find("div.item-card__shop-name").Text()
-		price := e.Attr("data-product-price") + ".0"
-		url, _ := e.DOM.Find("div.item-card__title a").Attr("href")
-		imageURL, _ := e.DOM.Find("div img").Attr("src")
-
-		if strings.HasPrefix("楽譜", shopName) {
-			return
-		}
+	return config.Client(oauth1.NoContext, token)
+}
 
-		item := &Item{
-			Category: category,
-			Name:     name,
-			ShopName: shopName,
-			Price:    price,
-			URL:      url,
-			ImageURL: imageURL,
-		}
-		items = append(items, item)
-	})
+func setupDiscord(cfg DiscordConfig) (*discordgo.Session, error) {
+	if cfg.BotToken == "" {
+		return nil, nil
+	}
 
-	err := c.Visit(baseURL)
+	discord, err := discordgo.New("Bot " + cfg.BotToken)
 	if err != nil {
 		return nil, err
 	}
+	discord.ShouldReconnectOnError = true
+	discord.AddHandler(func(_ *discordgo.Session, _ *discordgo.Disconnect) {
+		slog.Warn("discord disconnected")
+	})
+	discord.AddHandler(func(_ *discordgo.Session, _ *discordgo.Resumed) {
+		slog.Info("discord session resumed")
+	})
+	discord.AddHandler(func(_ *discordgo.Session, r *discordgo.Ready) {
+		slog.Info("discord session ready", "session_id", r.SessionID)
+	})
+	if err := discord.Open(); err != nil {
+		return nil, fmt.Errorf("error opening connection: %w", err)
+	}
+	return discord, nil
+}
 
-	return items, nil
+// ensureDiscordReady reopens s when its websocket has dropped and discordgo's
+// own reconnect has not brought it back yet.
+func ensureDiscordReady(s *discordgo.Session) error {
+	s.RLock()
+	ready := s.DataReady
+	s.RUnlock()
+	if ready {
+		return nil
+	}
+
+	slog.Warn("discord session not ready, reconnecting")
+	_ = s.Close()
+	if err := s.Open(); err != nil {
+		return fmt.Errorf("error reopening connection: %w", err)
+	}
+	slog.Info("discord session reconnected")
+	return nil
 }
 
-func run(ctx context.Context, db *bun.DB, item *Item, p NotifyParams) {
-	dbItem := itemFindByURL(ctx, db, item.URL)
-	url := item.URL
+// setupBluesky logs in, reusing the session stored in db when it's still valid.
+// New or refreshed sessions are saved back only when persist is set, so dry
+// runs leave bluesky_sessions untouched.
+func setupBluesky(ctx context.Context, db bun.IDB, cfg BlueskyConfig, persist bool) (*blueskyClient, error) {
+	identifier := cfg.Handle
+	password := cfg.Password
+	if identifier == "" || password == "" {
+		return nil, nil
+	}
 
-	if debug {
-		title := fmt.Sprintf("【テスト】【🆕新着情報🆕】 %s - %s", item.ShopName, item.Name)
-		msg := fmt.Sprintf("【テスト】【🆕新着情報🆕】\n\n%s\n%s\n%s円\n\n%s\n%s",
-			item.Category,
-			item.Name,
-			decimal.RequireFromString(item.Price),
-			item.URL,
-			item.ShopName,
-		)
+	host := cfg.PDSHost
+	if u, err := url.Parse(host); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid BLUESKY_PDS_HOST %q: must be an https URL", host)
+	}
 
-		notify(ctx, p, title, msg)
-	} else if dbItem.ID == 0 {
-		if err := insert(ctx, db, item); err != nil {
-			return
-		}
+	cli := &xrpc.Client{
+		Client: httpClient,
+		Host:   strings.TrimSuffix(host, "/"),
+	}
 
-		msg := fmt.Sprintf("【🆕新着情報🆕】\n\n%s\n%s\n%s円\n\n%s\n%s",
-			item.Category,
-			item.Name,
-			decimal.RequireFromString(item.Price),
-			item.URL,
-			item.ShopName,
-		)
+	ctx, cancel := context.WithTimeout(ctx, blueskySetupTimeout)
+	defer cancel()
 
-		notify(ctx, p, msg, url)
-	} else if item.Price != dbItem.Price {
-		oldPrice := decimal.RequireFromString(dbItem.Price)
-		newPrice := decimal.RequireFromString(item.Price)
-		dbItem.Price = item.Price
-		if err := update(ctx, db, dbItem); err != nil {
-			return
+	if stored, err := loadBlueskySession(ctx, db, identifier); err != nil {
+		slog.Warn("loading stored bluesky session failed", "error", err)
+	} else if stored != nil {
+		cli.Auth = &xrpc.AuthInfo{
+			AccessJwt:  stored.AccessJwt,
+			RefreshJwt: stored.RefreshJwt,
+			Handle:     stored.Handle,
+			Did:        stored.Did,
+		}
+		if time.Until(stored.ExpiresAt) > blueskySessionMargin {
+			slog.Debug("reusing stored bluesky session", "handle", stored.Handle)
+			return &blueskyClient{Client: cli, retryCount: cfg.RetryCount}, nil
+		}
+		err := refreshBlueskySession(ctx, cli)
+		if err == nil {
+			if persist {
+				if err := saveBlueskySession(ctx, db, identifier, cli.Auth); err != nil {
+					slog.Warn("saving bluesky session failed", "error", err)
+				}
+			}
+			return &blueskyClient{Client: cli, retryCount: cfg.RetryCount}, nil
 		}
+		slog.Warn("refreshing stored bluesky session failed, creating a new one", "error", err)
+	}
 
-		msg := fmt.Sprintf("【🆙更新情報🆙】\n\n%s\n%s\n%s円 -> %s円\n\n%s\n%s",
-			item.Category,
-			item.Name,
-			oldPrice,
-			newPrice,
-			item.URL,
-			item.ShopName,
-		)
+	input := &atproto.ServerCreateSession_Input{
+		Identifier: identifier,
+		Password:   password,
+	}
+	output, err := atproto.ServerCreateSession(ctx, cli, input)
+	if err != nil {
+		return nil, err
+	}
+	cli.Auth = &xrpc.AuthInfo{
+		AccessJwt:  output.AccessJwt,
+		RefreshJwt: output.RefreshJwt,
+		Handle:     output.Handle,
+		Did:        output.Did,
+	}
+	if persist {
+		if err := saveBlueskySession(ctx, db, identifier, cli.Auth); err != nil {
+			slog.Warn("saving bluesky session failed", "error", err)
+		}
+	}
+
+	return &blueskyClient{Client: cli, retryCount: cfg.RetryCount}, nil
+}
+
+func loadBlueskySession(ctx context.Context, db bun.IDB, identifier string) (*BlueskySession, error) {
+	session := new(BlueskySession)
+	err := db.NewSelect().Model(session).Where("identifier = ?", identifier).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func saveBlueskySession(ctx context.Context, db bun.IDB, identifier string, auth *xrpc.AuthInfo) error {
+	session := &BlueskySession{
+		Identifier: identifier,
+		Did:        auth.Did,
+		Handle:     auth.Handle,
+		AccessJwt:  auth.AccessJwt,
+		RefreshJwt: auth.RefreshJwt,
+		ExpiresAt:  jwtExpiry(auth.AccessJwt),
+		UpdatedAt:  time.Now(),
+	}
+	_, err := db.NewInsert().
+		Model(session).
+		On("CONFLICT (identifier) DO UPDATE").
+		Set("did = EXCLUDED.did").
+		Set("handle = EXCLUDED.handle").
+		Set("access_jwt = EXCLUDED.access_jwt").
+		Set("refresh_jwt = EXCLUDED.refresh_jwt").
+		Set("expires_at = EXCLUDED.expires_at").
+		Set("updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	return err
+}
+
+// jwtExpiry reads the exp claim of token without verifying it. It returns the
+// zero time when the token cannot be parsed, which forces a refresh.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+func setupMastodon(cfg MastodonConfig) *mastodon.Client {
+	if cfg.Server == "" || cfg.AccessToken == "" {
+		return nil
+	}
+
+	return mastodon.NewClient(&mastodon.Config{
+		Server:      cfg.Server,
+		AccessToken: cfg.AccessToken,
+	})
+}
+
+// blueskyClient is a logged-in PDS client and the retry policy for its requests.
+type blueskyClient struct {
+	*xrpc.Client
+	// retryCount is how often a request failing with a transient error is retried.
+	retryCount int
+}
+
+type lineClient struct {
+	token string
+	// to is a user, group or room ID to push to. Messages are broadcast when empty.
+	to string
+}
+
+func setupLine(cfg LineConfig) *lineClient {
+	if cfg.ChannelToken == "" {
+		return nil
+	}
+
+	return &lineClient{
+		token: cfg.ChannelToken,
+		to:    cfg.To,
+	}
+}
+
+type telegramClient struct {
+	token  string
+	chatID string
+}
+
+func setupTelegram(cfg TelegramConfig) *telegramClient {
+	if cfg.BotToken == "" || cfg.ChatID == "" {
+		return nil
+	}
+
+	return &telegramClient{
+		token:  cfg.BotToken,
+		chatID: cfg.ChatID,
+	}
+}
+
+func setupDB(ctx context.Context, dsn string) (*bun.DB, error) {
+	if dsn == "" {
+		return nil, errors.New("DATABASE_DSN environment variable not set")
+	}
+
+	// Database
+	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
+	db := bun.NewDB(sqldb, pgdialect.New())
+
+	var v string
+	if err := db.NewSelect().ColumnExpr("version()").Scan(ctx, &v); err != nil {
+		return nil, err
+	}
+	slog.Info("connected to database", "version", v)
+
+	// A brand-new database gets its schema here, so simple deployments need no
+	// manual -migrate up.
+	var exists bool
+	if err := db.NewSelect().ColumnExpr("to_regclass(?) IS NOT NULL", "items").Scan(ctx, &exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		slog.Debug("items table found, not creating tables")
+		return db, nil
+	}
+	slog.Info("items table not found, creating tables")
+	if err := runMigrations(ctx, db, "up"); err != nil {
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	slog.Info("created tables")
+
+	return db, nil
+}
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// newMigrator returns a migrator for the embedded migrations, creating its
+// bookkeeping tables if needed.
+func newMigrator(ctx context.Context, db *bun.DB) (*migrate.Migrator, error) {
+	fsys, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := migrate.NewMigrations()
+	if err := migrations.Discover(fsys); err != nil {
+		return nil, err
+	}
+
+	// Only record a rollback once it succeeds, so an irreversible migration stays applied.
+	migrator := migrate.NewMigrator(db, migrations, migrate.WithMarkAppliedOnSuccess(true))
+	if err := migrator.Init(ctx); err != nil {
+		return nil, err
+	}
+	return migrator, nil
+}
+
+// schemaModels are the tables the app reads and writes.
+var schemaModels = []any{
+	(*Item)(nil),
+	(*PriceHistory)(nil),
+	(*Run)(nil),
+	(*NotifyQueueEntry)(nil),
+	(*Digest)(nil),
+	(*BlueskySession)(nil),
+}
+
+// checkMigrations returns an error naming the tables and columns of
+// schemaModels that db lacks. Unapplied migrations are only logged, since a
+// database may already have their changes.
+func checkMigrations(ctx context.Context, db *bun.DB) error {
+	var missing []string
+	for _, model := range schemaModels {
+		table := db.Table(reflect.TypeOf(model))
+		var columns []string
+		err := db.NewSelect().
+			TableExpr("information_schema.columns").
+			Column("column_name").
+			Where("table_schema = current_schema()").
+			Where("table_name = ?", table.Name).
+			Scan(ctx, &columns)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			missing = append(missing, table.Name)
+			continue
+		}
+		for _, f := range table.Fields {
+			if !slices.Contains(columns, f.Name) {
+				missing = append(missing, table.Name+"."+f.Name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("database schema lacks %s; run with -migrate up or set AUTO_MIGRATE", strings.Join(missing, ", "))
+	}
+
+	migrator, err := newMigrator(ctx, db)
+	if err != nil {
+		return err
+	}
+	ms, err := migrator.MigrationsWithStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if pending := ms.Unapplied(); len(pending) > 0 {
+		slog.Warn("database has unapplied migrations", "migrations", pending.String())
+	}
+	return nil
+}
+
+// runMigrations applies the pending migrations in migrations/ when direction
+// is "up", or rolls back the last applied group when it is "down". Applied
+// versions are recorded in bun_migrations; Migrate and Rollback take the
+// migration lock themselves.
+func runMigrations(ctx context.Context, db *bun.DB, direction string) error {
+	migrator, err := newMigrator(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	var group *migrate.MigrationGroup
+	if direction == "down" {
+		group, err = migrator.Rollback(ctx)
+	} else {
+		group, err = migrator.Migrate(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if group.IsZero() {
+		slog.Info("no migrations to run", "direction", direction)
+		return nil
+	}
+	slog.Info("ran migrations", "direction", direction, "group", group.ID, "migrations", group.Migrations.String())
+	return nil
+}
+
+const (
+	defaultMaxPages   = 5
+	defaultRetryCount = 3
+	// defaultScrapeConcurrency scrapes queries one at a time unless SCRAPE_CONCURRENCY says otherwise.
+	defaultScrapeConcurrency = 1
+
+	// cardDescriptionMaxGraphemes caps item descriptions in Discord embeds and Bluesky link cards.
+	cardDescriptionMaxGraphemes = 200
+
+	blueskyMaxGraphemes = 300
+	defaultBlueskyHost  = "https://bsky.social"
+	// blueskyMaxBlobSize is the largest image blob Bluesky accepts for embeds.
+	blueskyMaxBlobSize  = 1_000_000
+	blueskySetupTimeout = 15 * time.Second
+	// blueskySessionMargin is how long a stored access token must still be valid to be reused as is.
+	blueskySessionMargin = 5 * time.Minute
+
+	// twitterMaxImageSize is the largest image the media upload endpoint takes in one request.
+	twitterMaxImageSize = 5 << 20
+	// maxImageFetchSize bounds how much of an image is read before shrinking it.
+	maxImageFetchSize = 20 << 20
+	// imageMaxDimension is the longest side kept when shrinking oversized images.
+	imageMaxDimension = 2000
+
+	// Discord's per-message limits; lengths are in characters.
+	discordMaxEmbeds        = 10
+	discordMaxMessageLength = 2000
+	discordMaxEmbedTitle    = 256
+	discordMaxFieldValue    = 1024
+	discordMaxFooterText    = 2048
+	discordMaxEmbedDesc     = 4096
+	discordMaxEmbedTotal    = 6000
+
+	// Slack's block text limits, in characters.
+	slackMaxHeaderText  = 150
+	slackMaxSectionText = 3000
+	// defaultLatestCount is how many items /latest shows without a count option.
+	defaultLatestCount = 5
+
+	// Failed notifications are retried up to maxNotifyAttempts times, waiting
+	// notifyRetryBackoff after the first failure and twice as long after each next one.
+	maxNotifyAttempts  = 5
+	notifyRetryBackoff = 5 * time.Minute
+	// notifyQueueBatch caps how many queued notifications are retried per run.
+	notifyQueueBatch = 50
+	// maxNotifyRetries caps how many items with failed notifications are retried per run.
+	maxNotifyRetries = 20
+
+	defaultBoothUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	// defaultBoothRequestDelay keeps consecutive BOOTH page requests at least this far apart.
+	defaultBoothRequestDelay = 2 * time.Second
+	// defaultBoothRequestRandomDelay adds up to this much jitter on top of BOOTH_REQUEST_DELAY.
+	defaultBoothRequestRandomDelay = time.Second
+	// boothDomainGlob matches BOOTH and its shop subdomains for the request limit rule.
+	boothDomainGlob     = "*booth.pm*"
+	defaultBoothLocale  = "ja"
+	defaultBoothBaseURL = "https://booth.pm"
+	defaultSortOrder    = "new"
+
+	// defaultNotifyDelay is the NOTIFY_DELAY used when unset; "0s" disables pacing.
+	defaultNotifyDelay = time.Second
+	sentryFlushTimeout = 2 * time.Second
+	defaultHTTPTimeout = 10 * time.Second
+	userAgent          = "touhou_booth_notify (+https://github.com/shiroemons/touhou_booth_notify)"
+
+	defaultTimezone = "Asia/Tokyo"
+
+	// backfillMaxPages bounds -backfill, which otherwise reads result pages until one is empty.
+	backfillMaxPages = 100
+
+	// ADULT_ITEMS values; unset notifies adult items like any other.
+	adultItemsSkip    = "skip"
+	adultItemsWarn    = "warn"
+	adultWarningLabel = "【R-18】"
+	// defaultBlueskyAdultLabel is the self-label for adult items unless BLUESKY_ADULT_LABELS says otherwise.
+	defaultBlueskyAdultLabel = "sexual"
+
+	defaultDigestInterval = 24 * time.Hour
+	digestTitle           = "【🗞本日の新着🗞】"
+	// twitterDigestMaxLength keeps a digest tweet within Twitter's limit, where Japanese characters count double.
+	twitterDigestMaxLength = 100
+
+	// runLockKey identifies this program's pg advisory lock.
+	runLockKey = 0x746f75686f75
+
+	defaultHashtags = "#booth_pm #東方デジタル音楽\n#東方Project #東方楽曲 #東方アレンジ"
+)
+
+var (
+	httpClient                           = &http.Client{Timeout: defaultHTTPTimeout}
+	_          bun.BeforeAppendModelHook = (*Item)(nil)
+	tagRe                                = regexp.MustCompile(`(?:^|\s)(#[^\s#]+)`)
+	linkRe                               = regexp.MustCompile(`https?://\S+`)
+)
+
+var (
+	itemsScraped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "items_scraped_total",
+		Help: "Number of items scraped from BOOTH.",
+	})
+	itemsNew = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "items_new_total",
+		Help: "Number of newly detected items.",
+	})
+	itemsPriceChanged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "items_price_changed_total",
+		Help: "Number of items whose price changed.",
+	})
+	itemsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "items_skipped_total",
+		Help: "Number of items skipped by filters.",
+	})
+	notifyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notify_errors_total",
+		Help: "Number of failed notifications per channel.",
+	}, []string{"channel"})
+)
+
+// runStats counts what a single pass did, for the summary logged at its end.
+// The prometheus counters above keep the totals across passes.
+type runStats struct {
+	scraped        atomic.Int64
+	new            atomic.Int64
+	priceChanged   atomic.Int64
+	skipped        atomic.Int64
+	notifyFailures atomic.Int64
+}
+
+var stats runStats
+
+func (s *runStats) reset() {
+	s.scraped.Store(0)
+	s.new.Store(0)
+	s.priceChanged.Store(0)
+	s.skipped.Store(0)
+	s.notifyFailures.Store(0)
+}
+
+// runSummary is the JSON form of runStats returned by the webhook.
+type runSummary struct {
+	Scraped        int64  `json:"scraped"`
+	New            int64  `json:"new"`
+	PriceChanged   int64  `json:"price_changed"`
+	Skipped        int64  `json:"skipped"`
+	NotifyFailures int64  `json:"notify_failures"`
+	DurationMS     int64  `json:"duration_ms"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (s *runStats) summary(startedAt time.Time) runSummary {
+	return runSummary{
+		Scraped:        s.scraped.Load(),
+		New:            s.new.Load(),
+		PriceChanged:   s.priceChanged.Load(),
+		Skipped:        s.skipped.Load(),
+		NotifyFailures: s.notifyFailures.Load(),
+		DurationMS:     time.Since(startedAt).Milliseconds(),
+	}
+}
+
+func (s *runStats) log(startedAt time.Time) {
+	slog.Info("run summary",
+		"scraped", s.scraped.Load(),
+		"new", s.new.Load(),
+		"price_changed", s.priceChanged.Load(),
+		"skipped", s.skipped.Load(),
+		"notify_failures", s.notifyFailures.Load(),
+		"duration", time.Since(startedAt).Round(time.Millisecond),
+	)
+}
+
+func init() {
+	envLoad()
+	if err := loadConfigFile(os.Getenv("CONFIG_FILE")); err != nil {
+		slog.Error("Error loading config file", "file", os.Getenv("CONFIG_FILE"), "error", err)
+		os.Exit(1)
+	}
+
+	time.Local = loadLocation()
+}
+
+// loadLocation returns the zone named by TIMEZONE or TZ, defaulting to
+// Asia/Tokyo. A fixed +9 zone is used when the zone database can't be read.
+func loadLocation() *time.Location {
+	name := getenvDefault("TIMEZONE", getenvDefault("TZ", defaultTimezone))
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("loading timezone failed, using +09:00", "timezone", name, "error", err)
+		return time.FixedZone("JST", 9*60*60)
+	}
+	return loc
+}
+
+func main() {
+	flags := parseFlags()
+	setupLogger(flags)
+	slog.Info("touhou booth notify start!")
+	cfg, err := loadConfig(flags)
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	httpClient.Timeout = cfg.HTTPTimeout
+
+	if err := setupSentry(cfg.Sentry); err != nil {
+		slog.Warn("sentry setup failed, skipping error reporting", "error", err)
+	}
+	defer sentry.Flush(sentryFlushTimeout)
+	defer func() {
+		if r := recover(); r != nil {
+			sentry.CurrentHub().Recover(r)
+			sentry.Flush(sentryFlushTimeout)
+			panic(r)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := start(ctx, cfg); err != nil {
+		slog.Error("touhou booth notify failed", "error", err)
+		sentry.CaptureException(err)
+		sentry.Flush(sentryFlushTimeout)
+		os.Exit(1)
+	}
+
+	slog.Info("touhou booth notify successfully completed!")
+}
+
+// setupSentry enables error reporting when SENTRY_DSN is set. Without it the
+// sentry calls elsewhere are no-ops.
+func setupSentry(cfg SentryConfig) error {
+	if cfg.DSN == "" {
+		return nil
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.DSN,
+		Environment: cfg.Environment,
+	})
+}
+
+// start connects to the database and the notification channels, then does what
+// cfg asks for: applies or rolls back migrations, sends a test notification,
+// serves the trigger webhook, watches every WatchInterval, or by default runs
+// a single scrape-and-notify pass. Deferred cleanups run before main exits.
+func start(ctx context.Context, cfg Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if cfg.MetricsAddr != "" {
+		startMetricsServer(ctx, cfg.MetricsAddr)
+	}
+
+	db, err := setupDB(ctx, cfg.DatabaseDSN)
+	if err != nil {
+		return fmt.Errorf("database setup: %w", err)
+	}
+	defer db.Close()
+
+	if cfg.Migrate != "" {
+		return runMigrations(ctx, db, cfg.Migrate)
+	}
+	// migrations/ is the only place the schema is defined; without AUTO_MIGRATE
+	// nothing runs against a database missing a table or column it needs.
+	if cfg.AutoMigrate {
+		if err := runMigrations(ctx, db, "up"); err != nil {
+			return fmt.Errorf("auto migrate: %w", err)
+		}
+	} else if err := checkMigrations(ctx, db); err != nil {
+		return err
+	}
+
+	unlock, locked, err := acquireRunLock(ctx, db)
+	if err != nil {
+		return fmt.Errorf("acquiring run lock: %w", err)
+	}
+	if !locked {
+		slog.Info("another run is in progress, exiting")
+		return nil
+	}
+	defer unlock()
+
+	lastRunAt, err := getLastRunAt(ctx, db)
+	if err != nil {
+		slog.Warn("loading last run failed", "error", err)
+	} else if !lastRunAt.IsZero() {
+		slog.Info("last successful run", "at", lastRunAt)
+	}
+	// Twitter client
+	var tClient *twitter.Client
+	var tV2Client *http.Client
+	tMediaClient := setupTwitterHTTPClient(cfg.Twitter)
+	if tMediaClient != nil {
+		if cfg.Twitter.APIV2 {
+			tV2Client = tMediaClient
+		} else {
+			tClient = twitter.NewClient(tMediaClient)
+		}
+	}
+	// Discord client
+	discord, err := setupDiscord(cfg.Discord)
+	if err != nil {
+		slog.Warn("discord setup failed, skipping discord", "error", err)
+	}
+	if discord != nil {
+		defer discord.Close()
+		// Dry runs must not change what the bot exposes on Discord.
+		if !cfg.DryRun {
+			if err := registerDiscordCommands(discord, db, cfg.Discord.GuildID); err != nil {
+				slog.Warn("registering discord commands failed", "error", err)
+			}
+		}
+	}
+	// Bluesky client
+	bClient, err := setupBluesky(ctx, db, cfg.Bluesky, !cfg.DryRun)
+	if err != nil {
+		slog.Warn("bluesky setup failed, skipping bluesky", "error", err)
+	}
+	if bClient != nil && !cfg.DryRun {
+		// postBluesky may refresh the session mid-run; keep the latest tokens for the next run.
+		defer func() {
+			if err := saveBlueskySession(context.Background(), db, cfg.Bluesky.Handle, bClient.Auth); err != nil {
+				slog.Warn("saving bluesky session failed", "error", err)
+			}
+		}()
+	}
+	// Mastodon client
+	mClient := setupMastodon(cfg.Mastodon)
+
+	params := NotifyParams{
+		tCli:                 tClient,
+		tV2Cli:               tV2Client,
+		tMediaCli:            tMediaClient,
+		dCli:                 discord,
+		bCli:                 bClient,
+		mCli:                 mClient,
+		slackURL:             cfg.Slack.WebhookURL,
+		lCli:                 setupLine(cfg.Line),
+		tgCli:                setupTelegram(cfg.Telegram),
+		channelID:            cfg.Discord.ChannelID,
+		dPlainText:           cfg.Discord.PlainText,
+		bImageEmbed:          cfg.Bluesky.ImageEmbed,
+		bAdultLabels:         cfg.Bluesky.AdultLabels,
+		bShopHandles:         cfg.Bluesky.ShopHandles,
+		tHashtags:            cfg.Twitter.Hashtags,
+		bHashtags:            cfg.Bluesky.Hashtags,
+		mHashtags:            cfg.Mastodon.Hashtags,
+		delay:                cfg.NotifyDelay,
+		maxItemAge:           cfg.MaxItemAge,
+		queue:                db,
+		dryRun:               cfg.DryRun,
+		filter:               cfg.Filter,
+		templates:            cfg.Templates,
+		scrape:               cfg.Scrape,
+		adultWarning:         cfg.AdultWarning,
+		notifyPriceIncreases: cfg.NotifyPriceIncreases,
+	}
+	// Muted channels keep their clients, e.g. for Discord commands, but get no posts.
+	if !cfg.Twitter.Enabled {
+		params.tCli, params.tV2Cli, params.tMediaCli = nil, nil, nil
+	}
+	if !cfg.Discord.Enabled {
+		params.dCli = nil
+	}
+	if !cfg.Bluesky.Enabled {
+		params.bCli = nil
+	}
+	slog.Info("notification channels",
+		"twitter", params.tCli != nil || params.tV2Cli != nil,
+		"discord", params.dCli != nil && params.channelID != "",
+		"bluesky", params.bCli != nil,
+		"mastodon", params.mCli != nil,
+		"slack", params.slackURL != "",
+		"line", params.lCli != nil,
+		"telegram", params.tgCli != nil,
+	)
+
+	if cfg.TestNotify {
+		return testNotify(ctx, params)
+	}
+	if params.dCli != nil && params.channelID != "" && cfg.Discord.Batch {
+		params.dBatch = &discordBatch{}
+	}
+
+	if cfg.WebhookAddr != "" {
+		return serveWebhook(ctx, db, cfg, params)
+	}
+
+	interval := cfg.WatchInterval
+	if interval <= 0 {
+		return process(ctx, db, cfg, params)
+	}
+
+	// Watch mode: keep the DB connection and clients for every iteration.
+	slog.Info("watching for new items", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := process(ctx, db, cfg, params); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Error("run failed", "error", err)
+			sentry.CaptureException(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveWebhook runs a pass for every authorized POST /trigger until ctx is done
+// and replies with the pass's summary. Passes never overlap: a trigger that
+// arrives during one gets 409 Conflict.
+func serveWebhook(ctx context.Context, db *bun.DB, cfg Config, params NotifyParams) error {
+	var running sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trigger", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		secret := r.Header.Get("X-Webhook-Secret")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.WebhookSecret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !running.TryLock() {
+			http.Error(w, "a run is already in progress", http.StatusConflict)
+			return
+		}
+		defer running.Unlock()
+
+		slog.Info("run triggered by webhook", "remote", r.RemoteAddr)
+		startedAt := time.Now()
+		// The pass uses the server's ctx so a client hanging up doesn't abort it.
+		err := process(ctx, db, cfg, params)
+		summary := stats.summary(startedAt)
+		status := http.StatusOK
+		if err != nil {
+			slog.Error("run failed", "error", err)
+			sentry.CaptureException(err)
+			summary.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(summary)
+	})
+	srv := &http.Server{
+		Addr:              cfg.WebhookAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	slog.Info("webhook server listening", "addr", cfg.WebhookAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// testNotify posts a canned message to every configured channel and reports
+// which ones succeeded, so credentials can be checked before deploying.
+// A dry run logs the message instead of posting it.
+func testNotify(ctx context.Context, p NotifyParams) error {
+	item := &Item{
+		Name:  "テスト通知",
+		Price: "0",
+		URL:   defaultBoothBaseURL,
+	}
+	msg := "【テスト】touhou booth notify の通知テストです"
+	if p.dryRun {
+		// publish only logs the message in a dry run, so there is nothing to report.
+		publish(ctx, p, msg, item)
+		return nil
+	}
+	result, err := notify(ctx, p, msg, item)
+
+	channels := []struct {
+		name       string
+		configured bool
+		ok         bool
+	}{
+		{"twitter", p.tCli != nil || p.tV2Cli != nil, result.Twitter},
+		{"discord", p.dCli != nil && p.channelID != "", result.Discord},
+		{"bluesky", p.bCli != nil, result.Bluesky},
+		{"mastodon", p.mCli != nil, result.Mastodon},
+		{"slack", p.slackURL != "", result.Slack},
+		{"line", p.lCli != nil, result.Line},
+		{"telegram", p.tgCli != nil, result.Telegram},
+	}
+	for _, c := range channels {
+		switch {
+		case !c.configured:
+			slog.Info("test notification", "channel", c.name, "status", "not configured")
+		case c.ok:
+			slog.Info("test notification", "channel", c.name, "status", "ok")
+		default:
+			slog.Error("test notification", "channel", c.name, "status", "failed")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("test notification: %w", err)
+	}
+	return nil
+}
+
+// process scrapes BOOTH once and handles every item found.
+func process(ctx context.Context, db *bun.DB, cfg Config, params NotifyParams) error {
+	startedAt := time.Now()
+	defer itemPages.reset()
+	defer uploadedBlobs.reset()
+	// Drop whatever an aborted pass left behind.
+	processed.take()
+	stats.reset()
+
+	// Digest mode posts nothing per item; new items go out in the digest instead.
+	itemParams := params
+	if cfg.DigestMode {
+		itemParams = params.withoutChannels()
+	}
+	if !cfg.Seed && !cfg.Backfill {
+		drainNotifyQueue(ctx, db, itemParams)
+		// Retry before handling new items so a channel that fails this run is
+		// only retried on the next one.
+		retryFailedNotifications(ctx, db, itemParams)
+	}
+
+	opts := cfg.Scrape
+	if cfg.Backfill {
+		opts.MaxPages = backfillMaxPages
+	}
+	items, err := getItems(ctx, cfg.Queries, opts)
+	if err != nil {
+		return fmt.Errorf("getItems: %w", err)
+	}
+	slog.Debug("scraped items", "count", len(items))
+	itemsScraped.Add(float64(len(items)))
+	stats.scraped.Add(int64(len(items)))
+
+	if cfg.Seed {
+		if err := seed(ctx, db, cfg, items); err != nil {
+			return fmt.Errorf("seed: %w", err)
+		}
+		if cfg.DryRun {
+			return nil
+		}
+		return recordRun(ctx, db, startedAt)
+	}
+	if cfg.Backfill {
+		if err := backfill(ctx, db, cfg, items); err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+		if cfg.DryRun {
+			return nil
+		}
+		return recordRun(ctx, db, startedAt)
+	}
+
+	if cfg.MaxItemsPerRun > 0 {
+		items, err = capNewItems(ctx, db, items, cfg.MaxItemsPerRun, cfg.Filter)
+		if err != nil {
+			return fmt.Errorf("capping new items: %w", err)
+		}
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		runSafely(ctx, db, items[i], itemParams)
+	}
+
+	flushDiscordBatch(ctx, itemParams)
+	if cfg.OutputJSON != "" {
+		if err := writeProcessedItems(cfg.OutputJSON, processed.take()); err != nil {
+			slog.Error("writing JSON output failed", "error", err)
+		}
+	}
+	if cfg.DigestMode {
+		if err := postDigestIfDue(ctx, db, params, cfg.DigestInterval); err != nil {
+			slog.Error("posting digest failed", "error", err)
+			sentry.CaptureException(err)
+		}
+	}
+	stats.log(startedAt)
+
+	if !cfg.DryRun {
+		if err := recordRun(ctx, db, startedAt); err != nil {
+			slog.Error("recording run failed", "error", err)
+			sentry.CaptureException(err)
+		}
+	}
+	return nil
+}
+
+// startMetricsServer serves /healthz and /metrics on addr until ctx is done.
+func startMetricsServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		slog.Info("metrics server listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+}
+
+func (i *Item) BeforeAppendModel(_ context.Context, query bun.Query) error {
+	switch query.(type) {
+	case *bun.InsertQuery:
+		now := time.Now()
+		i.CreatedAt = now
+		i.UpdatedAt = now
+	case *bun.UpdateQuery:
+		i.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// buildShopURL returns the URL of the given page of a shop's item listing.
+func buildShopURL(shopURL string, page int) string {
+	u := shopURL + "/items"
+	if page > 1 {
+		u += "?page=" + strconv.Itoa(page)
+	}
+	return u
+}
+
+func buildSearchURL(baseURL string, q SearchQuery, opts ScrapeOptions, page int) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL %q: %w", baseURL, err)
+	}
+	root := strings.TrimSuffix(u.Path, "/") + "/" + opts.Locale
+	u.Path = root + "/items"
+	if q.Category != "" {
+		u.Path = root + "/browse/" + q.Category
+	}
+
+	v := url.Values{}
+	if q.Keyword != "" {
+		v.Set("q", q.Keyword)
+	}
+	if q.Type != "" {
+		v.Set("type", q.Type)
+	}
+	if q.InStock {
+		v.Set("in_stock", "true")
+	}
+	sortOrder := q.SortOrder
+	if sortOrder == "" {
+		sortOrder = opts.SortOrder
+	}
+	if sortOrder != "" {
+		v.Set("sort", sortOrder)
+	}
+	if opts.NewArrivalOnly {
+		v.Set("new_arrival", "true")
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	u.RawQuery = v.Encode()
+
+	return u.String(), nil
+}
+
+func getItems(ctx context.Context, queries []SearchQuery, opts ScrapeOptions) ([]*Item, error) {
+	if opts.ShopURL != "" {
+		// A shop listing takes no search parameters, so it is scraped once.
+		queries = []SearchQuery{{}}
+	}
+	// Each query is paged through by its own worker; results keep the query order.
+	results := make([][]*Item, len(queries))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(opts.Concurrency, 1))
+	for i := range queries {
+		g.Go(func() error {
+			items, err := scrapeQuery(ctx, &queries[i], opts)
+			results[i] = items
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var items []*Item
+	for _, r := range results {
+		items = append(items, r...)
+	}
+	return uniqueItems(items), nil
+}
+
+// saveDebugHTML writes the outer HTML of the item card e to a new file in dir
+// so selector breakage can be diagnosed after the fact.
+func saveDebugHTML(e *colly.HTMLElement, dir string) {
+	html, err := goquery.OuterHtml(e.DOM)
+	if err != nil {
+		slog.Warn("rendering item card html failed", "error", err)
+		return
+	}
+	f, err := os.CreateTemp(dir, "item-card-*.html")
+	if err != nil {
+		slog.Warn("saving item card html failed", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(html); err != nil {
+		slog.Warn("saving item card html failed", "file", f.Name(), "error", err)
+		return
+	}
+	slog.Info("saved item card html", "file", f.Name(), "page", e.Request.URL.String())
+}
+
+// scrapeQuery visits the result pages of query until one comes back empty or
+// opts.MaxPages is reached.
+func scrapeQuery(ctx context.Context, query *SearchQuery, opts ScrapeOptions) ([]*Item, error) {
+	c, err := newBoothCollector(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := opts.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBoothBaseURL
+	}
+
+	sel := opts.Selectors
+	if sel == (Selectors{}) {
+		sel = defaultSelectors
+	}
+
+	var items []*Item
+	var found int
+	c.OnHTML(sel.Card, func(e *colly.HTMLElement) {
+		found++
+		category := e.DOM.Find(sel.Category).Text()
+		name := e.DOM.Find(sel.Title).Text()
+		shopName := e.DOM.Find(sel.ShopName).Text()
+		rawPrice := e.Attr(sel.PriceAttr)
+		url, _ := e.DOM.Find(sel.Link).Attr("href")
+		shopURL, _ := e.DOM.Find(sel.ShopLink).Attr("href")
+		imageURL, _ := e.DOM.Find(sel.Image).Attr("src")
+		url = resolveURL(e.Request.URL, url)
+		shopURL = resolveURL(e.Request.URL, shopURL)
+		imageURL = resolveURL(e.Request.URL, imageURL)
+		currency := detectCurrency(e.DOM.Find(sel.Price).Text())
+		stock := e.DOM.Find(sel.SoldOut).Length() == 0
+		adult := e.DOM.Find(sel.Adult).Length() > 0
+
+		if strings.TrimSpace(name) == "" || strings.TrimSpace(rawPrice) == "" {
+			slog.Warn("item card parsed with empty fields", "url", url, "name", name, "price", rawPrice)
+			if opts.DebugHTMLDir != "" {
+				saveDebugHTML(e, opts.DebugHTMLDir)
+			}
+		}
+		if strings.Contains(shopName, "楽譜") {
+			return
+		}
+		price, err := decimal.NewFromString(strings.TrimSpace(rawPrice))
+		if err != nil {
+			slog.Warn("skipping item with unparseable price", "url", url, "price", rawPrice, "error", err)
+			return
+		}
+
+		item := &Item{
+			Category: category,
+			Name:     name,
+			ShopName: shopName,
+			ShopURL:  shopURL,
+			Price:    price.String(),
+			URL:      url,
+			ImageURL: imageURL,
+			Currency: currency,
+			Stock:    stock,
+			Adult:    adult,
+			Query:    query,
+		}
+		items = append(items, item)
+	})
+
+	for page := 1; page <= opts.MaxPages; page++ {
+		found = 0
+		var searchURL string
+		if opts.ShopURL != "" {
+			searchURL = buildShopURL(opts.ShopURL, page)
+		} else if searchURL, err = buildSearchURL(baseURL, *query, opts, page); err != nil {
+			return nil, err
+		}
+		err = visitWithRetry(ctx, c, searchURL, opts.RetryCount)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if found == 0 {
+			break
+		}
+	}
+
+	return items, nil
+}
+
+// newBoothCollector returns a collector for requests to BOOTH, paced by opts'
+// delays and aborting its requests once ctx is done.
+func newBoothCollector(ctx context.Context, opts ScrapeOptions) (*colly.Collector, error) {
+	c := colly.NewCollector(
+		colly.AllowURLRevisit(),
+		colly.UserAgent(opts.UserAgent),
+	)
+	if opts.Transport != nil {
+		c.WithTransport(opts.Transport)
+	}
+	// Fixture servers behind BaseURL don't need pacing, so only BOOTH is limited.
+	if err := c.Limit(&colly.LimitRule{
+		DomainGlob:  boothDomainGlob,
+		Delay:       opts.Delay,
+		RandomDelay: opts.RandomDelay,
+	}); err != nil {
+		return nil, err
+	}
+	c.OnRequest(func(r *colly.Request) {
+		if ctx.Err() != nil {
+			r.Abort()
+		}
+	})
+	return c, nil
+}
+
+// currencyMarkers maps price text markers to ISO 4217 codes, checked in order.
+var currencyMarkers = []struct {
+	marker string
+	code   string
+}{
+	{"JPY", "JPY"},
+	{"¥", "JPY"},
+	{"円", "JPY"},
+	{"USD", "USD"},
+	{"US$", "USD"},
+	{"EUR", "EUR"},
+	{"€", "EUR"},
+	{"KRW", "KRW"},
+	{"₩", "KRW"},
+	{"TWD", "TWD"},
+	{"NT$", "TWD"},
+	{"CNY", "CNY"},
+	{"$", "USD"},
+}
+
+func detectCurrency(text string) string {
+	for _, m := range currencyMarkers {
+		if strings.Contains(text, m.marker) {
+			return m.code
+		}
+	}
+	return "JPY"
+}
+
+func formatPrice(price decimal.Decimal, currency string) string {
+	switch currency {
+	case "", "JPY":
+		return price.String() + "円"
+	case "USD":
+		return "$" + price.StringFixed(2)
+	case "EUR":
+		return "€" + price.StringFixed(2)
+	default:
+		return price.String() + " " + currency
+	}
+}
+
+// formatPriceChange describes the change from oldPrice to newPrice as a percentage
+// rounded to one decimal place, e.g. "📉-20%". It returns "" when oldPrice is zero,
+// where a percentage is undefined.
+func formatPriceChange(oldPrice, newPrice decimal.Decimal) string {
+	if oldPrice.IsZero() {
+		return ""
+	}
+	pct := newPrice.Sub(oldPrice).Div(oldPrice).Mul(decimal.NewFromInt(100)).Round(1)
+	switch pct.Sign() {
+	case -1:
+		return "📉" + pct.String() + "%"
+	case 1:
+		return "📈+" + pct.String() + "%"
+	default:
+		return "±0%"
+	}
+}
+
+// itemPrice formats item's price for display, falling back to the raw value if it doesn't parse.
+func itemPrice(item *Item) string {
+	price, err := decimal.NewFromString(item.Price)
+	if err != nil {
+		return item.Price
+	}
+	return formatPrice(price, item.Currency)
+}
+
+func visitWithRetry(ctx context.Context, c *colly.Collector, u string, retryCount int) error {
+	err := c.Visit(u)
+	for i := 0; err != nil && i < retryCount; i++ {
+		wait := time.Duration(1<<i) * time.Second
+		wait += time.Duration(rand.Int63n(int64(wait / 2)))
+		slog.Warn("visit failed, retrying", "url", u, "error", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		err = c.Visit(u)
+	}
+	return err
+}
+
+// resolveURL makes ref absolute against the page it was scraped from, since
+// BOOTH may emit relative hrefs and items are keyed by URL.
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+func uniqueItems(items []*Item) []*Item {
+	seen := make(map[string]struct{}, len(items))
+	result := make([]*Item, 0, len(items))
+	for _, item := range items {
+		if _, ok := seen[item.URL]; ok {
+			continue
+		}
+		seen[item.URL] = struct{}{}
+		result = append(result, item)
+	}
+	return result
+}
+
+// capNewItems keeps the oldest limit items that are not stored yet, along with
+// every stored item. The dropped items stay uninserted, so a later run still
+// sees them as new; they are the newest, so they are the last to fall off the
+// scraped pages before then.
+func capNewItems(ctx context.Context, db bun.IDB, items []*Item, limit int, filter ItemFilter) ([]*Item, error) {
+	urls := make([]string, 0, len(items))
+	for _, item := range items {
+		urls = append(urls, item.URL)
+	}
+	var stored []string
+	if len(urls) > 0 {
+		err := db.NewSelect().Model((*Item)(nil)).Column("url").Where("url IN (?)", bun.In(urls)).Scan(ctx, &stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kept := make([]*Item, 0, len(items))
+	var newCount int
+	var deferred []string
+	// items are newest first, so walk them backwards and keep them in order.
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		isNew := !slices.Contains(stored, item.URL) && validateItem(item) == nil && filter.skipReason(item) == ""
+		if isNew {
+			if newCount >= limit {
+				deferred = append(deferred, item.URL)
+				continue
+			}
+			newCount++
+		}
+		kept = append(kept, item)
+	}
+	slices.Reverse(kept)
+	if len(deferred) > 0 {
+		slog.Warn("deferring new items to a later run", "deferred", len(deferred), "limit", limit, "urls", deferred)
+	}
+	return kept, nil
+}
+
+// Statuses of a processedItem.
+const (
+	itemNew       = "new"
+	itemUpdated   = "updated"
+	itemUnchanged = "unchanged"
+	itemSkipped   = "skipped"
+)
+
+// processedItem is one entry of the OUTPUT_JSON array.
+type processedItem struct {
+	Status   string `json:"status"`
+	URL      string `json:"url"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	ShopName string `json:"shop_name"`
+	Price    string `json:"price"`
+	Currency string `json:"currency"`
+	InStock  bool   `json:"in_stock"`
+	// OldPrice is set for updated items whose price changed.
+	OldPrice string   `json:"old_price,omitempty"`
+	Changes  []string `json:"changes,omitempty"`
+}
+
+func newProcessedItem(item *Item, status string) processedItem {
+	return processedItem{
+		Status:   status,
+		URL:      item.URL,
+		Name:     item.Name,
+		Category: item.Category,
+		ShopName: item.ShopName,
+		Price:    item.Price,
+		Currency: item.Currency,
+		InStock:  item.Stock,
+	}
+}
+
+// processedItems collects what run did with each item during one pass.
+type processedItems struct {
+	mu    sync.Mutex
+	items []processedItem
+}
+
+var processed = &processedItems{}
+
+func (p *processedItems) add(item processedItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = append(p.items, item)
+}
+
+func (p *processedItems) take() []processedItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	items := p.items
+	p.items = nil
+	return items
+}
+
+// writeProcessedItems writes items as a JSON array to the file name, or to
+// stdout when name is "-". Logs go to stderr, so stdout stays valid JSON.
+func writeProcessedItems(name string, items []processedItem) error {
+	if items == nil {
+		items = []processedItem{}
+	}
+	b, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(name, b, 0o644)
+}
+
+// runSafely calls run, recovering from a panic so one bad listing can't stop
+// the remaining items from being processed.
+func runSafely(ctx context.Context, db *bun.DB, item *Item, p NotifyParams) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic while processing item", "url", item.URL, "panic", r, "stack", string(debug.Stack()))
+			sentry.CurrentHub().Recover(r)
+		}
+	}()
+	run(ctx, db, item, p)
+}
+
+func run(ctx context.Context, db *bun.DB, item *Item, p NotifyParams) {
+	if err := validateItem(item); err != nil {
+		slog.Warn("skipping invalid item", "url", item.URL, "error", err)
+		stats.skipped.Add(1)
+		processed.add(newProcessedItem(item, itemSkipped))
+		return
+	}
+	if reason := p.filter.skipReason(item); reason != "" {
+		slog.Debug("skipping item", "url", item.URL, "reason", reason)
+		itemsSkipped.Inc()
+		stats.skipped.Add(1)
+		processed.add(newProcessedItem(item, itemSkipped))
+		return
+	}
+	dbItem := itemFindByURL(ctx, db, item.URL)
+	slog.Debug("processing item", "url", item.URL, "id", dbItem.ID)
+
+	d, err := decideItem(dbItem, item, p)
+	if err != nil {
+		slog.Warn("skipping item", "url", item.URL, "error", err)
+		return
+	}
+
+	switch d.action {
+	case actionNoOp:
+		processed.add(newProcessedItem(item, itemUnchanged))
+		return
+	case actionInsert:
+		if p.scrape.Detail {
+			if err := scrapeItemDetail(ctx, p.scrape, item); err != nil {
+				slog.Warn("scraping item detail failed", "url", item.URL, "error", err)
+			}
+		}
+		if item.Description == "" {
+			item.Description = fetchDescription(ctx, item.URL)
+		}
+		// The publish time only matters for MAX_ITEM_AGE, so don't spend a request on it otherwise.
+		if item.PublishedAt.IsZero() && p.maxItemAge > 0 {
+			if publishedAt, err := fetchPublishedAt(ctx, p.scrape, item.URL); err != nil {
+				slog.Warn("fetching item publish time failed", "url", item.URL, "error", err)
+			} else {
+				item.PublishedAt = publishedAt
+			}
+		}
+		if !p.dryRun {
+			var inserted bool
+			err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+				var err error
+				inserted, err = insert(ctx, tx, item)
+				return err
+			})
+			if err != nil {
+				slog.Error("insert failed", "url", item.URL, "error", err)
+				sentry.CaptureException(err)
+				return
+			}
+			if !inserted {
+				if existing := itemFindByURL(ctx, db, item.URL); existing.ID != 0 {
+					slog.Info("item was inserted concurrently, skipping", "url", item.URL)
+					return
+				}
+			}
+		}
+
+		itemsNew.Inc()
+		stats.new.Add(1)
+		processed.add(newProcessedItem(item, itemNew))
+		if p.maxItemAge > 0 && !item.PublishedAt.IsZero() && time.Since(item.PublishedAt) > p.maxItemAge {
+			slog.Info("not notifying old item", "url", item.URL, "published_at", item.PublishedAt)
+			return
+		}
+		msg := newItemMessage(item, d.newPrice, p.templates)
+
+		if p.dBatch != nil {
+			// Discord gets this item in the end-of-run batch instead.
+			p.dBatch.add(item)
+			p.dCli = nil
+		}
+		result := publish(ctx, p, msg, item)
+		if !p.dryRun && item.ID != 0 {
+			markNotified(item, p, result)
+			if err := saveNotified(ctx, db, item); err != nil {
+				slog.Error("saving notification status failed", "url", item.URL, "error", err)
+				sentry.CaptureException(err)
+			}
+		}
+		return
+	}
+
+	// Lets failed update notifications be queued against the stored item.
+	item.ID = dbItem.ID
+	item.Description = dbItem.Description
+	item.Adult = item.Adult || dbItem.Adult
+	dbItem.Name = item.Name
+	dbItem.Category = item.Category
+	dbItem.ImageURL = item.ImageURL
+	dbItem.Price = item.Price
+	dbItem.Currency = item.Currency
+	dbItem.ShopURL = item.ShopURL
+	dbItem.Stock = item.Stock
+	if !p.dryRun {
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := update(ctx, tx, dbItem); err != nil {
+				return err
+			}
+			if d.priceChanged {
+				return insertPriceHistory(ctx, tx, dbItem)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("update failed", "url", item.URL, "error", err)
+			sentry.CaptureException(err)
+			return
+		}
+	}
+	out := newProcessedItem(item, itemUpdated)
+	if d.priceChanged {
+		out.OldPrice = d.oldPrice.String()
+		itemsPriceChanged.Inc()
+		stats.priceChanged.Add(1)
+	}
+	out.Changes = d.changes
+	processed.add(out)
+
+	if d.updateMessage != "" {
+		up := p
+		if d.imageChanged {
+			// The link card's og:image may still be the old art, so embed the new image itself.
+			up.bImageEmbed = true
+		}
+		publish(ctx, up, d.updateMessage, item)
+	}
+	if d.stockMessage != "" {
+		publish(ctx, p, d.stockMessage, item)
+	}
+}
+
+// itemAction is what run does with a scraped item.
+type itemAction int
+
+const (
+	actionNoOp itemAction = iota
+	actionInsert
+	actionUpdate
+)
+
+// itemDecision is decideItem's verdict on a scraped item.
+type itemDecision struct {
+	action       itemAction
+	oldPrice     decimal.Decimal
+	newPrice     decimal.Decimal
+	priceChanged bool
+	stockChanged bool
+	imageChanged bool
+	changes      []string
+	// updateMessage and stockMessage are the posts for actionUpdate; empty means nothing to announce.
+	updateMessage string
+	stockMessage  string
+}
+
+// decideItem compares scraped with its stored row, which has a zero ID if there is none.
+// It touches neither the DB nor any channel; p only supplies the post settings.
+// For actionInsert no message is built, since run fills in the item's details first.
+func decideItem(stored, scraped *Item, p NotifyParams) (itemDecision, error) {
+	var d itemDecision
+	newPrice, err := decimal.NewFromString(scraped.Price)
+	if err != nil {
+		return d, fmt.Errorf("invalid price %q: %w", scraped.Price, err)
+	}
+	d.newPrice = newPrice
+	if stored.ID == 0 {
+		d.action = actionInsert
+		return d, nil
+	}
+
+	oldPrice, err := decimal.NewFromString(stored.Price)
+	if err != nil {
+		return d, fmt.Errorf("invalid stored price %q: %w", stored.Price, err)
+	}
+	d.oldPrice = oldPrice
+	d.changes = describeChanges(stored, scraped)
+	// Compare numerically: stored prices may carry a different scale, e.g. "1000.0".
+	d.priceChanged = !newPrice.Equal(oldPrice)
+	d.stockChanged = scraped.Stock != stored.Stock
+	if !d.priceChanged && !d.stockChanged && len(d.changes) == 0 {
+		return d, nil
+	}
+	d.action = actionUpdate
+	d.imageChanged = stored.ImageURL != scraped.ImageURL
+
+	// Messages use the stored description and adult flag, as run does when publishing.
+	item := *scraped
+	item.Description = stored.Description
+	item.Adult = scraped.Adult || stored.Adult
+
+	// A price rise is still stored but, with NOTIFY_PRICE_INCREASES off, left
+	// out of the post as if the price hadn't changed.
+	announcePrice := d.priceChanged && (p.notifyPriceIncreases || newPrice.LessThan(oldPrice))
+	if announcePrice || len(d.changes) > 0 {
+		priceLine := formatPrice(newPrice, item.Currency)
+		if announcePrice {
+			priceLine = fmt.Sprintf("%s -> %s", formatPrice(oldPrice, stored.Currency), formatPrice(newPrice, item.Currency))
+			if change := formatPriceChange(oldPrice, newPrice); change != "" {
+				priceLine += " (" + change + ")"
+			}
+		}
+		var changeLines string
+		if len(d.changes) > 0 {
+			changeLines = "\n" + strings.Join(d.changes, "\n") + "\n"
+		}
+		msg := fmt.Sprintf("【🆙更新情報🆙】\n\n%s\n%s\n%s\n%s\n%s\n%s",
+			item.Category,
+			item.Name,
+			priceLine,
+			changeLines,
+			item.URL,
+			item.ShopName,
+		)
+		data := newPostData(&item, newPrice)
+		if announcePrice {
+			data.OldPrice = formatPrice(oldPrice, stored.Currency)
+			data.PriceChange = formatPriceChange(oldPrice, newPrice)
+		}
+		data.Changes = d.changes
+		d.updateMessage = renderPost(p.templates.Update, data, msg)
+	}
+
+	if d.stockChanged {
+		status := "売り切れになりました"
+		if item.Stock {
+			status = "再入荷しました"
+		}
+		d.stockMessage = fmt.Sprintf("【在庫情報】\n\n%s\n%s\n%s\n\n%s\n%s",
+			item.Category,
+			item.Name,
+			status,
+			item.URL,
+			item.ShopName,
+		)
+	}
+	return d, nil
+}
+
+func newItemMessage(item *Item, price decimal.Decimal, templates PostTemplates) string {
+	msg := fmt.Sprintf("【🆕新着情報🆕】\n\n%s\n%s\n%s\n\n%s\n%s",
+		item.Category,
+		item.Name,
+		formatPrice(price, item.Currency),
+		item.URL,
+		item.ShopName,
+	)
+	return renderPost(templates.NewItem, newPostData(item, price), msg)
+}
+
+// markNotified records on item the outcome for each tracked channel p attempted;
+// a nil Notified* field means the channel was never attempted.
+// Channels p didn't attempt keep their previous value.
+func markNotified(item *Item, p NotifyParams, r NotifyResult) {
+	if p.tCli != nil || p.tV2Cli != nil {
+		item.NotifiedTwitter = &r.Twitter
+	}
+	if p.dCli != nil && p.channelID != "" {
+		item.NotifiedDiscord = &r.Discord
+	}
+	if p.bCli != nil {
+		item.NotifiedBluesky = &r.Bluesky
+	}
+}
+
+// drainNotifyQueue retries the queued notifications that are due. Entries are
+// removed once they succeed or run out of attempts; entries for channels that
+// are not configured in this run are left for a later one.
+func drainNotifyQueue(ctx context.Context, db *bun.DB, p NotifyParams) {
+	if p.dryRun {
+		return
+	}
+	var entries []*NotifyQueueEntry
+	err := db.NewSelect().Model(&entries).
+		Where("next_retry_at <= ?", time.Now()).
+		Order("id ASC").
+		Limit(notifyQueueBatch).
+		Scan(ctx)
+	if err != nil {
+		slog.Error("loading notify queue failed", "error", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		cp, ok := channelParams(p, e.Channel)
+		if !ok {
+			continue
+		}
+		item := new(Item)
+		if err := db.NewSelect().Model(item).Where("id = ?", e.ItemID).Scan(ctx); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				slog.Warn("dropping queued notification for missing item", "channel", e.Channel, "item_id", e.ItemID)
+				deleteQueueEntry(ctx, db, e)
+			} else {
+				slog.Error("loading queued item failed", "item_id", e.ItemID, "error", err)
+			}
+			continue
+		}
+
+		slog.Info("retrying queued notification", "channel", e.Channel, "url", item.URL, "attempt", e.Attempts+1)
+		result, err := notify(ctx, cp, e.Payload, item)
+		if err == nil {
+			deleteQueueEntry(ctx, db, e)
+			markNotified(item, cp, result)
+			if err := saveNotified(ctx, db, item); err != nil {
+				slog.Error("saving notification status failed", "url", item.URL, "error", err)
+				sentry.CaptureException(err)
+			}
+			continue
+		}
+		// Being rate limited isn't the post's fault: wait out the limit without using up an attempt.
+		var rl *rateLimitError
+		if errors.As(err, &rl) {
+			e.NextRetryAt = rl.reset
+			if _, err := db.NewUpdate().Model(e).Column("next_retry_at").WherePK().Exec(ctx); err != nil {
+				slog.Error("rescheduling queued notification failed", "id", e.ID, "error", err)
+			}
+			continue
+		}
+
+		e.Attempts++
+		if e.Attempts >= maxNotifyAttempts {
+			slog.Error("giving up on notification", "channel", e.Channel, "url", item.URL, "attempts", e.Attempts)
+			deleteQueueEntry(ctx, db, e)
+			continue
+		}
+		e.NextRetryAt = time.Now().Add(notifyRetryBackoff << (e.Attempts - 1))
+		if _, err := db.NewUpdate().Model(e).Column("attempts", "next_retry_at").WherePK().Exec(ctx); err != nil {
+			slog.Error("rescheduling queued notification failed", "id", e.ID, "error", err)
+		}
+	}
+}
+
+// retryFailedNotifications re-posts stored items to the channels whose last
+// attempt failed, independently of whether the items were scraped this run.
+// Channels with a queued notification for the item are left to drainNotifyQueue.
+func retryFailedNotifications(ctx context.Context, db *bun.DB, p NotifyParams) {
+	items, err := pendingNotifications(ctx, db, maxNotifyRetries)
+	if err != nil {
+		slog.Error("loading failed notifications failed", "error", err)
+		sentry.CaptureException(err)
+		return
+	}
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return
+		}
+		var queued []string
+		err := db.NewSelect().Model((*NotifyQueueEntry)(nil)).
+			Column("channel").
+			Where("item_id = ?", item.ID).
+			Scan(ctx, &queued)
+		if err != nil {
+			slog.Error("loading queued notifications failed", "item_id", item.ID, "error", err)
+			continue
+		}
+		rp, ok := failedChannels(p, item, queued)
+		if !ok {
+			continue
+		}
+		price, err := decimal.NewFromString(item.Price)
+		if err != nil {
+			slog.Warn("skipping retry of item with invalid stored price", "url", item.URL, "price", item.Price, "error", err)
+			continue
+		}
+		slog.Info("retrying failed notifications", "url", item.URL)
+		result := publish(ctx, rp, newItemMessage(item, price, p.templates), item)
+		if p.dryRun {
+			continue
+		}
+		markNotified(item, rp, result)
+		if err := saveNotified(ctx, db, item); err != nil {
+			slog.Error("saving notification status failed", "url", item.URL, "error", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// failedChannels narrows p to the tracked channels whose last attempt for item
+// failed and that aren't in queued, reporting false when there is nothing to retry.
+// A retry that fails again is left to the next run rather than queued.
+func failedChannels(p NotifyParams, item *Item, queued []string) (NotifyParams, bool) {
+	failed := func(notified *bool, channel string) bool {
+		return notified != nil && !*notified && !slices.Contains(queued, channel)
+	}
+	rp := p.withoutChannels()
+	if failed(item.NotifiedTwitter, "twitter") {
+		rp.tCli, rp.tV2Cli, rp.tMediaCli = p.tCli, p.tV2Cli, p.tMediaCli
+	}
+	if failed(item.NotifiedDiscord, "discord") {
+		rp.dCli = p.dCli
+	}
+	if failed(item.NotifiedBluesky, "bluesky") {
+		rp.bCli = p.bCli
+	}
+	ok := rp.tCli != nil || rp.tV2Cli != nil || (rp.dCli != nil && rp.channelID != "") || rp.bCli != nil
+	return rp, ok
+}
+
+// enqueueNotification stores a notification of msg for item on channel that
+// couldn't be sent, to be retried from retryAt on.
+func enqueueNotification(ctx context.Context, db bun.IDB, channel string, itemID int64, msg string, retryAt time.Time) {
+	e := &NotifyQueueEntry{
+		Channel:     channel,
+		ItemID:      itemID,
+		Payload:     msg,
+		NextRetryAt: retryAt,
+	}
+	if _, err := db.NewInsert().Model(e).Exec(ctx); err != nil {
+		slog.Error("queueing failed notification failed", "channel", channel, "item_id", itemID, "error", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func deleteQueueEntry(ctx context.Context, db bun.IDB, e *NotifyQueueEntry) {
+	if _, err := db.NewDelete().Model(e).WherePK().Exec(ctx); err != nil {
+		slog.Error("removing queued notification failed", "id", e.ID, "error", err)
+	}
+}
+
+// channelParams narrows p to the single channel named by channel, reporting
+// false when that channel is not configured.
+func channelParams(p NotifyParams, channel string) (NotifyParams, bool) {
+	cp := p.withoutChannels()
+	switch channel {
+	case "twitter":
+		cp.tCli, cp.tV2Cli, cp.tMediaCli = p.tCli, p.tV2Cli, p.tMediaCli
+	case "discord":
+		cp.dCli = p.dCli
+	case "bluesky":
+		cp.bCli = p.bCli
+	case "mastodon":
+		cp.mCli = p.mCli
+	case "slack":
+		cp.slackURL = p.slackURL
+	case "line":
+		cp.lCli = p.lCli
+	case "telegram":
+		cp.tgCli = p.tgCli
+	}
+	ok := cp.tCli != nil || cp.tV2Cli != nil || (cp.dCli != nil && cp.channelID != "") || cp.bCli != nil ||
+		cp.mCli != nil || cp.slackURL != "" || cp.lCli != nil || cp.tgCli != nil
+	return cp, ok
+}
+
+// PostData is the value NEW_ITEM_TEMPLATE and UPDATE_ITEM_TEMPLATE are executed with.
+type PostData struct {
+	Name        string
+	Category    string
+	Price       string
+	ShopName    string
+	ShopURL     string
+	URL         string
+	Description string
+	// Tags and Images come from the item detail and are empty unless SCRAPE_DETAIL is set.
+	Tags   []string
+	Images []string
+	// OldPrice is the previous price, set only for updates that changed the price.
+	OldPrice string
+	// PriceChange is the change from OldPrice, e.g. "📉-20%"; empty when OldPrice was zero.
+	PriceChange string
+	// Changes lists the non-price differences of an update.
+	Changes []string
+}
+
+func newPostData(item *Item, price decimal.Decimal) PostData {
+	return PostData{
+		Name:        item.Name,
+		Category:    item.Category,
+		Price:       formatPrice(price, item.Currency),
+		ShopName:    item.ShopName,
+		ShopURL:     item.ShopURL,
+		URL:         item.URL,
+		Description: item.Description,
+		Tags:        item.Tags,
+		Images:      item.Images,
+	}
+}
+
+// PostTemplates holds the operator's message templates; a nil template keeps the built-in format.
+type PostTemplates struct {
+	NewItem *template.Template
+	Update  *template.Template
+}
+
+func loadPostTemplates() (PostTemplates, error) {
+	var t PostTemplates
+	var err error
+	if t.NewItem, err = loadPostTemplate("NEW_ITEM_TEMPLATE"); err != nil {
+		return t, err
+	}
+	if t.Update, err = loadPostTemplate("UPDATE_ITEM_TEMPLATE"); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// loadPostTemplate reads the template from key, or from the file named by key+"_FILE".
+func loadPostTemplate(key string) (*template.Template, error) {
+	text := os.Getenv(key)
+	if path := os.Getenv(key + "_FILE"); text == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s_FILE: %w", key, err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return nil, nil
+	}
+
+	t, err := template.New(key).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	// Executing once with sample data catches references to unknown fields at startup.
+	sample := PostData{Name: "name", Price: "0円", OldPrice: "0円", PriceChange: "📉-0%", Changes: []string{"change"}}
+	if err := t.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return t, nil
+}
+
+// renderPost executes t with data, returning fallback when t is nil or fails.
+func renderPost(t *template.Template, data PostData, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		slog.Warn("rendering post template failed, using default format", "template", t.Name(), "url", data.URL, "error", err)
+		return fallback
+	}
+	return b.String()
+}
+
+// describeChanges lists the non-price differences between the stored and scraped item.
+func describeChanges(old, cur *Item) []string {
+	var changes []string
+	if old.Name != cur.Name {
+		changes = append(changes, fmt.Sprintf("タイトル: %s -> %s", old.Name, cur.Name))
+	}
+	if old.Category != cur.Category {
+		changes = append(changes, fmt.Sprintf("カテゴリ: %s -> %s", old.Category, cur.Category))
+	}
+	if old.ImageURL != cur.ImageURL {
+		changes = append(changes, "画像が更新されました")
+	}
+	return changes
+}
+
+// publish sends msg to every configured channel, or only logs it in dry-run mode.
+func publish(ctx context.Context, p NotifyParams, msg string, item *Item) NotifyResult {
+	if p.adultWarning && item.Adult {
+		msg = adultWarningLabel + msg
+	}
+	if p.dryRun {
+		preview(p, msg)
+		return NotifyResult{}
+	}
+	result, err := notify(ctx, p, msg, item)
+	if err != nil {
+		slog.Warn("some notifications failed", "url", item.URL)
+	}
+	// Pace consecutive notifications so bursts of items don't trip platform rate limits.
+	if p.delay > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.delay):
+		}
+	}
+	return result
+}
+
+func preview(p NotifyParams, msg string) {
+	if p.tCli != nil || p.tV2Cli != nil {
+		slog.Info("[dry-run]", "channel", "twitter", "message", withHashtags(msg, p.tHashtags))
+	}
+	if p.dCli != nil && p.channelID != "" {
+		slog.Info("[dry-run]", "channel", "discord", "message", msg)
+	}
+	if p.bCli != nil {
+		slog.Info("[dry-run]", "channel", "bluesky", "message", withHashtags(msg, p.bHashtags))
+	}
+	if p.mCli != nil {
+		slog.Info("[dry-run]", "channel", "mastodon", "message", withHashtags(msg, p.mHashtags))
+	}
+	if p.slackURL != "" {
+		slog.Info("[dry-run]", "channel", "slack", "message", msg)
+	}
+	if p.lCli != nil {
+		slog.Info("[dry-run]", "channel", "line", "message", msg)
+	}
+	if p.tgCli != nil {
+		slog.Info("[dry-run]", "channel", "telegram", "message", msg)
+	}
+}
+
+func itemFindByURL(ctx context.Context, db *bun.DB, url string) *Item {
+	dbItem := new(Item)
+	_ = db.NewSelect().Model(dbItem).Where("url = ?", url).Scan(ctx)
+
+	return dbItem
+}
+
+// seed stores every scraped item in one batch without notifying, so that a
+// fresh database starts from a baseline instead of announcing all listings.
+func seed(ctx context.Context, db *bun.DB, cfg Config, items []*Item) error {
+	var seedItems []*Item
+	for i := len(items) - 1; i >= 0; i-- {
+		if cfg.Filter.skipReason(items[i]) == "" {
+			seedItems = append(seedItems, items[i])
+		}
+	}
+	if len(seedItems) == 0 {
+		return nil
+	}
+	if cfg.DryRun {
+		slog.Info("[dry-run] seed", "count", len(seedItems))
+		return nil
+	}
+
+	var inserted []struct {
+		ID    int64
+		Price string
+	}
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// Items already stored, e.g. on later watch-mode passes, are left alone.
+		_, err := tx.NewInsert().Model(&seedItems).
+			On("CONFLICT (url) DO NOTHING").
+			Returning("id, price").
+			Exec(ctx, &inserted)
+		if err != nil || len(inserted) == 0 {
+			return err
+		}
+		histories := make([]*PriceHistory, 0, len(inserted))
+		for _, row := range inserted {
+			histories = append(histories, &PriceHistory{
+				ItemID:     row.ID,
+				Price:      row.Price,
+				RecordedAt: time.Now(),
+			})
+		}
+		_, err = tx.NewInsert().Model(&histories).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("seeded items", "count", len(inserted), "scraped", len(seedItems))
+	return nil
+}
+
+// backfill inserts every scraped item not yet stored, without notifying.
+// Existing URLs are skipped, so it is safe to run against a populated table.
+func backfill(ctx context.Context, db *bun.DB, cfg Config, items []*Item) error {
+	var newItems []*Item
+	for i := len(items) - 1; i >= 0; i-- {
+		if cfg.Filter.skipReason(items[i]) == "" {
+			newItems = append(newItems, items[i])
+		}
+	}
+	if len(newItems) == 0 {
+		slog.Info("backfilled items", "imported", 0, "scraped", len(items))
+		return nil
+	}
+	if cfg.DryRun {
+		slog.Info("[dry-run] backfill", "count", len(newItems))
+		return nil
+	}
+
+	var inserted []struct {
+		ID    int64
+		Price string
+	}
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// Scan the returned rows separately: with DO NOTHING they no longer
+		// line up with newItems.
+		_, err := tx.NewInsert().Model(&newItems).
+			On("CONFLICT (url) DO NOTHING").
+			Returning("id, price").
+			Exec(ctx, &inserted)
+		if err != nil || len(inserted) == 0 {
+			return err
+		}
+		histories := make([]*PriceHistory, 0, len(inserted))
+		for _, row := range inserted {
+			histories = append(histories, &PriceHistory{
+				ItemID:     row.ID,
+				Price:      row.Price,
+				RecordedAt: time.Now(),
+			})
+		}
+		_, err = tx.NewInsert().Model(&histories).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("backfilled items", "imported", len(inserted), "scraped", len(items))
+	return nil
+}
+
+// latestItems returns up to limit of the most recently added items.
+func latestItems(ctx context.Context, db bun.IDB, limit int) ([]*Item, error) {
+	var items []*Item
+	err := db.NewSelect().Model(&items).Order("created_at DESC").Limit(limit).Scan(ctx)
+	return items, err
+}
+
+// pendingNotifications returns up to limit of the newest items with a tracked
+// channel whose last notification attempt failed.
+func pendingNotifications(ctx context.Context, db bun.IDB, limit int) ([]*Item, error) {
+	var items []*Item
+	err := db.NewSelect().Model(&items).
+		WhereOr("notified_twitter = false").
+		WhereOr("notified_discord = false").
+		WhereOr("notified_bluesky = false").
+		Order("created_at DESC").
+		Limit(limit).
+		Scan(ctx)
+	return items, err
+}
+
+// acquireRunLock takes a session-level advisory lock so only one run works the
+// database at a time. It reports false, without error, when another run holds it.
+func acquireRunLock(ctx context.Context, db *bun.DB) (unlock func(), locked bool, err error) {
+	// Advisory locks belong to a connection, so pin one for the lifetime of the lock.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(?)", runLockKey).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, false, nil
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(?)", runLockKey); err != nil {
+			slog.Warn("releasing run lock failed", "error", err)
+		}
+		conn.Close()
+	}, true, nil
+}
+
+// getLastRunAt returns the finish time of the last successful run, or the zero time if there is none.
+func getLastRunAt(ctx context.Context, db bun.IDB) (time.Time, error) {
+	r := new(Run)
+	err := db.NewSelect().Model(r).Order("finished_at DESC").Limit(1).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return r.FinishedAt, err
+}
+
+func recordRun(ctx context.Context, db bun.IDB, startedAt time.Time) error {
+	r := &Run{
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+	_, err := db.NewInsert().Model(r).Exec(ctx)
+	return err
+}
+
+// insert stores a new item and its first price. It reports false when another
+// run has already inserted an item with the same URL.
+func insert(ctx context.Context, db bun.IDB, item *Item) (bool, error) {
+	res, err := db.NewInsert().Model(item).On("CONFLICT (url) DO NOTHING").Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, insertPriceHistory(ctx, db, item)
+}
+
+func update(ctx context.Context, db bun.IDB, item *Item) error {
+	_, err := db.NewUpdate().Model(item).WherePK().Exec(ctx)
+	return err
+}
+
+func saveNotified(ctx context.Context, db bun.IDB, item *Item) error {
+	_, err := db.NewUpdate().Model(item).
+		Column("notified_twitter", "notified_discord", "notified_bluesky").
+		WherePK().
+		Exec(ctx)
+	return err
+}
+
+func insertPriceHistory(ctx context.Context, db bun.IDB, item *Item) error {
+	history := &PriceHistory{
+		ItemID:     item.ID,
+		Price:      item.Price,
+		RecordedAt: time.Now(),
+	}
+	_, err := db.NewInsert().Model(history).Exec(ctx)
+	return err
+}
+
+// NotifyResult reports which channels the message was successfully posted to.
+type NotifyResult struct {
+	Twitter  bool
+	Discord  bool
+	Bluesky  bool
+	Mastodon bool
+	Slack    bool
+	Line     bool
+	Telegram bool
+}
+
+func notify(ctx context.Context, p NotifyParams, msg string, item *Item) (NotifyResult, error) {
+	var result NotifyResult
+	var errs []error
+	record := func(channel string, ok *bool, err error) {
+		if err != nil {
+			slog.Error("notification failed", "channel", channel, "url", item.URL, "shop", item.ShopName, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+			sentry.CaptureException(errs[len(errs)-1])
+			notifyErrors.WithLabelValues(channel).Inc()
+			stats.notifyFailures.Add(1)
+			if p.queue != nil && item.ID != 0 {
+				enqueueNotification(ctx, p.queue, channel, item.ID, msg, time.Now().Add(notifyRetryBackoff))
+			}
+			return
+		}
+		slog.Info("notification sent", "channel", channel, "url", item.URL, "shop", item.ShopName)
+		*ok = true
+	}
+
+	tweetMsg := msg
+	if item.ShopURL != "" {
+		tweetMsg += "\n" + item.ShopURL
+	}
+	if p.tCli != nil || p.tV2Cli != nil {
+		if until := twitterCooldown.get(); time.Now().Before(until) {
+			slog.Warn("skipping twitter while rate limited", "url", item.URL, "until", until)
+			// The tweet is sent once the cooldown is over instead of being dropped.
+			if p.queue != nil && item.ID != 0 {
+				enqueueNotification(ctx, p.queue, "twitter", item.ID, msg, until)
+			}
+			errs = append(errs, fmt.Errorf("twitter: %w", &rateLimitError{reset: until}))
+		} else {
+			var mediaIDs []int64
+			if p.tMediaCli != nil && item.ImageURL != "" {
+				if id, err := uploadTwitterMedia(ctx, p.tMediaCli, item.ImageURL); err != nil {
+					slog.Warn("uploading image to twitter failed, tweeting text only", "url", item.URL, "error", err)
+				} else {
+					mediaIDs = []int64{id}
+				}
+			}
+			var err error
+			if p.tCli != nil {
+				err = tweet(ctx, p.tCli, withHashtags(tweetMsg, p.tHashtags), mediaIDs)
+			} else {
+				err = tweetV2(ctx, p.tV2Cli, withHashtags(tweetMsg, p.tHashtags), mediaIDs)
+			}
+			var rl *rateLimitError
+			if errors.As(err, &rl) {
+				twitterCooldown.set(rl.reset)
+			}
+			record("twitter", &result.Twitter, err)
+		}
+	}
+	if p.dCli != nil && p.channelID != "" {
+		if p.dPlainText {
+			record("discord", &result.Discord, sendMessage(ctx, p.dCli, p.channelID, msg))
+		} else {
+			record("discord", &result.Discord, sendEmbed(ctx, p.dCli, p.channelID, msg, item))
+		}
+	}
+	if p.bCli != nil {
+		opts := blueskyPostOptions{
+			imageEmbed:  p.bImageEmbed,
+			labels:      blueskyLabels(p, item),
+			shopHandles: p.bShopHandles,
+		}
+		record("bluesky", &result.Bluesky, postBluesky(ctx, p.bCli, withHashtags(msg, p.bHashtags), item, opts))
+	}
+	if p.mCli != nil {
+		record("mastodon", &result.Mastodon, postMastodon(ctx, p.mCli, withHashtags(msg, p.mHashtags)))
+	}
+	if p.slackURL != "" {
+		record("slack", &result.Slack, postSlack(ctx, p.slackURL, msg, item))
+	}
+	if p.lCli != nil {
+		record("line", &result.Line, postLine(ctx, p.lCli, msg, item))
+	}
+	if p.tgCli != nil {
+		record("telegram", &result.Telegram, postTelegram(ctx, p.tgCli, msg, item))
+	}
+	return result, errors.Join(errs...)
+}
+
+func withHashtags(msg, tags string) string {
+	if tags == "" {
+		return msg
+	}
+	return msg + "\n\n" + tags
+}
+
+// twitterCooldown holds when Twitter may be called again after a 429 response.
+var twitterCooldown cooldown
+
+type cooldown struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func (c *cooldown) get() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.until
+}
+
+func (c *cooldown) set(until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.until = until
+}
+
+type rateLimitError struct {
+	reset time.Time
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited until %s", e.reset.Format(time.RFC3339))
+}
+
+// rateLimitReset reads x-rate-limit-reset, falling back to Twitter's 15 minute window.
+func rateLimitReset(resp *http.Response) time.Time {
+	if n, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64); err == nil {
+		return time.Unix(n, 0)
+	}
+	return time.Now().Add(15 * time.Minute)
+}
+
+// tweet posts msg with the v1.1 API. go-twitter takes no context, so ctx can
+// only stop a tweet that hasn't been sent yet.
+func tweet(ctx context.Context, cli *twitter.Client, msg string, mediaIDs []int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var params *twitter.StatusUpdateParams
+	if len(mediaIDs) > 0 {
+		params = &twitter.StatusUpdateParams{MediaIds: mediaIDs}
+	}
+	_, resp, err := cli.Statuses.Update(msg, params)
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return &rateLimitError{reset: rateLimitReset(resp)}
+	}
+	return err
+}
+
+func tweetV2(ctx context.Context, cli *http.Client, msg string, mediaIDs []int64) error {
+	payload := map[string]any{"text": msg}
+	if len(mediaIDs) > 0 {
+		ids := make([]string, len(mediaIDs))
+		for i, id := range mediaIDs {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		payload["media"] = map[string][]string{"media_ids": ids}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.twitter.com/2/tweets", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &rateLimitError{reset: rateLimitReset(resp)}
+	}
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, b)
+	}
+	return nil
+}
+
+// uploadTwitterMedia downloads imageURL and uploads it through the v1.1 media
+// endpoint, which both the v1.1 and v2 tweet APIs accept media IDs from.
+func uploadTwitterMedia(ctx context.Context, cli *http.Client, imageURL string) (int64, error) {
+	resp, err := httpGet(ctx, imageURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status fetching %s: %s", imageURL, resp.Status)
+	}
+	img, err := io.ReadAll(io.LimitReader(resp.Body, twitterMaxImageSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(img) > twitterMaxImageSize {
+		return 0, fmt.Errorf("image %s exceeds %d bytes", imageURL, twitterMaxImageSize)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("media", path.Base(imageURL))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := fw.Write(img); err != nil {
+		return 0, err
+	}
+	if err := mw.Close(); err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://upload.twitter.com/1.1/media/upload.json", &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return 0, fmt.Errorf("unexpected status: %s: %s", res.Status, b)
+	}
+
+	var out struct {
+		MediaID int64 `json:"media_id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.MediaID, nil
+}
+
+// sendMessage posts msg, split into several messages if it exceeds Discord's length limit.
+func sendMessage(ctx context.Context, s *discordgo.Session, channelID, msg string) error {
+	if err := ensureDiscordReady(s); err != nil {
+		return err
+	}
+	for _, part := range splitMessage(msg, discordMaxMessageLength) {
+		if _, err := s.ChannelMessageSend(channelID, part, discordgo.WithContext(ctx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitMessage breaks msg into parts of at most limit characters, preferring
+// line boundaries and only cutting inside a line that is longer than limit.
+func splitMessage(msg string, limit int) []string {
+	var parts []string
+	var cur []rune
+	for _, line := range strings.SplitAfter(msg, "\n") {
+		r := []rune(line)
+		if len(cur)+len(r) > limit && len(cur) > 0 {
+			parts = append(parts, string(cur))
+			cur = nil
+		}
+		for len(r) > limit {
+			parts = append(parts, string(r[:limit]))
+			r = r[limit:]
+		}
+		cur = append(cur, r...)
+	}
+	if len(cur) > 0 {
+		parts = append(parts, string(cur))
+	}
+	return parts
+}
+
+func sendEmbed(ctx context.Context, s *discordgo.Session, channelID, msg string, item *Item) error {
+	if err := ensureDiscordReady(s); err != nil {
+		return err
+	}
+	content, embed := messageEmbed(msg, item)
+	_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: content,
+		Embed:   embed,
+	}, discordgo.WithContext(ctx))
+	return err
+}
+
+// messageEmbed splits msg into the 新着/更新 heading on its first line, sent as
+// the message content, and an embed for item whose description leads with the
+// rest of msg, so price changes, stock status and template output are kept.
+func messageEmbed(msg string, item *Item) (string, *discordgo.MessageEmbed) {
+	heading, body, _ := strings.Cut(msg, "\n")
+	embed := itemEmbed(item)
+	if body = strings.TrimSpace(body); body != "" {
+		room := discordMaxEmbedTotal - embedLength(embed) + utf8.RuneCountInString(embed.Description)
+		if embed.Description != "" {
+			body += "\n\n" + embed.Description
+		}
+		embed.Description = truncateRunes(body, min(discordMaxEmbedDesc, room))
+	}
+	return heading, embed
+}
+
+// itemEmbed builds the Discord embed for item, truncating each part to Discord's embed limits.
+func itemEmbed(item *Item) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title: truncateRunes(item.Name, discordMaxEmbedTitle),
+		URL:   item.URL,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "価格", Value: itemPrice(item), Inline: true},
+		},
+	}
+	// Items loaded from the database have no shop name, only the shop URL.
+	switch {
+	case item.ShopName != "" && item.ShopURL != "":
+		shop := fmt.Sprintf("[%s](%s)", item.ShopName, item.ShopURL)
+		if utf8.RuneCountInString(shop) > discordMaxFieldValue {
+			shop = truncateRunes(item.ShopName, discordMaxFieldValue)
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "ショップ", Value: shop, Inline: true})
+	case item.ShopName != "" || item.ShopURL != "":
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "ショップ", Value: truncateRunes(item.ShopName+item.ShopURL, discordMaxFieldValue), Inline: true})
+	}
+	if item.Category != "" {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: truncateRunes(item.Category, discordMaxFooterText)}
+	}
+	if item.ImageURL != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: item.ImageURL}
+	}
+	if item.Description != "" {
+		embed.Description = truncateGraphemes(item.Description, cardDescriptionMaxGraphemes)
+	}
+	return embed
+}
+
+// embedLength counts the characters Discord applies its per-message embed total to.
+func embedLength(e *discordgo.MessageEmbed) int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	if e.Footer != nil {
+		n += utf8.RuneCountInString(e.Footer.Text)
+	}
+	return n
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// registerDiscordCommands registers /latest and answers it from db for as long as s is open.
+func registerDiscordCommands(s *discordgo.Session, db *bun.DB, guildID string) error {
+	minCount := float64(1)
+	_, err := s.ApplicationCommandCreate(s.State.User.ID, guildID, &discordgo.ApplicationCommand{
+		Name:        "latest",
+		Description: "最近登録されたアイテムを表示します",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "count",
+				Description: "表示する件数",
+				MinValue:    &minCount,
+				MaxValue:    discordMaxEmbeds,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand || i.ApplicationCommandData().Name != "latest" {
+			return
+		}
+		count := defaultLatestCount
+		for _, o := range i.ApplicationCommandData().Options {
+			if o.Name == "count" {
+				count = int(o.IntValue())
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
+		defer cancel()
+		data := &discordgo.InteractionResponseData{}
+		items, err := latestItems(ctx, db, count)
+		if err != nil {
+			slog.Error("loading latest items failed", "error", err)
+			data.Content = "アイテムの取得に失敗しました"
+		} else if len(items) == 0 {
+			data.Content = "アイテムがありません"
+		}
+		for _, item := range items {
+			data.Embeds = append(data.Embeds, itemEmbed(item))
+		}
+		if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: data,
+		}); err != nil {
+			slog.Error("responding to /latest failed", "error", err)
+		}
+	})
+	return nil
+}
+
+// discordBatch collects new items so they go out as one Discord message per run.
+type discordBatch struct {
+	mu    sync.Mutex
+	items []*Item
+}
+
+func (b *discordBatch) add(item *Item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items = append(b.items, item)
+}
+
+func (b *discordBatch) take() []*Item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := b.items
+	b.items = nil
+	return items
+}
+
+// flushDiscordBatch posts the batched new items, up to discordMaxEmbeds per message.
+func flushDiscordBatch(ctx context.Context, p NotifyParams) {
+	if p.dBatch == nil {
+		return
+	}
+	sendDiscordItems(ctx, p, "【🆕新着情報🆕】", p.dBatch.take())
+}
+
+// sendDiscordItems posts items under title, up to discordMaxEmbeds per message.
+func sendDiscordItems(ctx context.Context, p NotifyParams, title string, items []*Item) {
+	for len(items) > 0 {
+		// Fill each message up to the embed count and total length limits.
+		n, total := 0, 0
+		for n < min(len(items), discordMaxEmbeds) {
+			l := embedLength(itemEmbed(items[n]))
+			if n > 0 && total+l > discordMaxEmbedTotal {
+				break
+			}
+			n, total = n+1, total+l
+		}
+		chunk := items[:n]
+		items = items[n:]
+
+		heading := fmt.Sprintf("%s %d件", title, len(chunk))
+		if p.dryRun {
+			for _, item := range chunk {
+				heading += "\n" + item.Name + " " + item.URL
+			}
+			slog.Info("[dry-run]", "channel", "discord", "message", heading)
+			continue
+		}
+
+		var err error
+		if p.dPlainText {
+			lines := []string{heading}
+			for _, item := range chunk {
+				lines = append(lines, "", item.Name, itemPrice(item), item.URL)
+			}
+			err = sendMessage(ctx, p.dCli, p.channelID, strings.Join(lines, "\n"))
+		} else {
+			embeds := make([]*discordgo.MessageEmbed, 0, len(chunk))
+			for _, item := range chunk {
+				embeds = append(embeds, itemEmbed(item))
+			}
+			if err = ensureDiscordReady(p.dCli); err == nil {
+				_, err = p.dCli.ChannelMessageSendComplex(p.channelID, &discordgo.MessageSend{
+					Content: heading,
+					Embeds:  embeds,
+				}, discordgo.WithContext(ctx))
+			}
+		}
+		if err != nil {
+			slog.Error("notification failed", "channel", "discord", "items", len(chunk), "error", err)
+			notifyErrors.WithLabelValues("discord").Inc()
+			stats.notifyFailures.Add(1)
+			continue
+		}
+		slog.Info("notification sent", "channel", "discord", "items", len(chunk))
+	}
+}
+
+// postDigestIfDue posts a roundup of the items created since the last digest
+// once interval has passed since it, and records the digest.
+func postDigestIfDue(ctx context.Context, db bun.IDB, p NotifyParams, interval time.Duration) error {
+	last, err := getLastDigestAt(ctx, db)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if last.IsZero() {
+		last = now.Add(-interval)
+	} else if now.Sub(last) < interval {
+		slog.Debug("digest not due yet", "last", last)
+		return nil
+	}
+
+	var items []*Item
+	err = db.NewSelect().Model(&items).Where("created_at > ?", last).Order("created_at ASC").Scan(ctx)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		postDigest(ctx, p, items)
+	}
+	if p.dryRun {
+		return nil
+	}
+	_, err = db.NewInsert().Model(&Digest{PostedAt: now, ItemCount: len(items)}).Exec(ctx)
+	return err
+}
+
+func getLastDigestAt(ctx context.Context, db bun.IDB) (time.Time, error) {
+	d := new(Digest)
+	err := db.NewSelect().Model(d).Order("posted_at DESC").Limit(1).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return d.PostedAt, err
+}
+
+// digestMessage lists items as a numbered roundup.
+func digestMessage(items []*Item) string {
+	lines := []string{fmt.Sprintf("%s %d件", digestTitle, len(items))}
+	for i, item := range items {
+		lines = append(lines, "", fmt.Sprintf("%d. %s (%s)", i+1, item.Name, itemPrice(item)), item.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// postDigest sends the roundup of items to every configured channel: an embed
+// list for Discord and a numbered list everywhere else.
+func postDigest(ctx context.Context, p NotifyParams, items []*Item) {
+	msg := digestMessage(items)
+	// A tweet only has room for the first few lines.
+	tweetMsg := splitMessage(msg, twitterDigestMaxLength)[0]
+	if p.dryRun {
+		preview(p, msg)
+		return
+	}
+
+	record := func(channel string, err error) {
+		if err != nil {
+			slog.Error("digest failed", "channel", channel, "items", len(items), "error", err)
+			sentry.CaptureException(fmt.Errorf("%s digest: %w", channel, err))
+			notifyErrors.WithLabelValues(channel).Inc()
+			stats.notifyFailures.Add(1)
+			return
+		}
+		slog.Info("digest sent", "channel", channel, "items", len(items))
+	}
+	if p.tCli != nil {
+		record("twitter", tweet(ctx, p.tCli, tweetMsg, nil))
+	} else if p.tV2Cli != nil {
+		record("twitter", tweetV2(ctx, p.tV2Cli, tweetMsg, nil))
+	}
+	if p.dCli != nil && p.channelID != "" {
+		sendDiscordItems(ctx, p, digestTitle, items)
+	}
+	if p.bCli != nil {
+		record("bluesky", postBluesky(ctx, p.bCli, msg, nil, blueskyPostOptions{}))
+	}
+	if p.mCli != nil {
+		record("mastodon", postMastodon(ctx, p.mCli, msg))
+	}
+	if p.slackURL != "" {
+		record("slack", postJSON(ctx, p.slackURL, nil, slackMessage{Text: msg}))
+	}
+	if p.lCli != nil {
+		record("line", postLine(ctx, p.lCli, msg, &Item{}))
+	}
+	if p.tgCli != nil {
+		record("telegram", postTelegram(ctx, p.tgCli, msg, &Item{}))
+	}
+}
+
+func postMastodon(ctx context.Context, cli *mastodon.Client, msg string) error {
+	_, err := cli.PostStatus(ctx, &mastodon.Toot{
+		Status:     msg,
+		Visibility: mastodon.VisibilityPublic,
+		Language:   "ja",
+	})
+	return err
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks,omitempty"`
+}
+
+type slackBlock struct {
+	Type      string           `json:"type"`
+	Text      *slackText       `json:"text,omitempty"`
+	Accessory *slackBlockImage `json:"accessory,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlockImage struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+// slackEscaper escapes the characters Slack's mrkdwn treats as control characters.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func postSlack(ctx context.Context, webhookURL, msg string, item *Item) error {
+	return postJSON(ctx, webhookURL, nil, slackItemMessage(msg, item))
+}
+
+// slackItemMessage lays msg out as blocks: its first line as the header, and
+// a section linking item followed by the rest of msg, since Slack shows the
+// blocks instead of the text.
+func slackItemMessage(msg string, item *Item) slackMessage {
+	title, body, _ := strings.Cut(msg, "\n")
+	text := fmt.Sprintf("*<%s|%s>*", item.URL, slackEscaper.Replace(item.Name))
+	if body = strings.TrimSpace(body); body != "" {
+		text += "\n" + slackEscaper.Replace(body)
+	}
+	section := slackBlock{
+		Type: "section",
+		Text: &slackText{
+			Type: "mrkdwn",
+			Text: truncateRunes(text, slackMaxSectionText),
+		},
+	}
+	if item.ImageURL != "" {
+		section.Accessory = &slackBlockImage{
+			Type:     "image",
+			ImageURL: item.ImageURL,
+			AltText:  item.Name,
+		}
+	}
+	return slackMessage{
+		Text: msg,
+		Blocks: []slackBlock{
+			{Type: "header", Text: &slackText{Type: "plain_text", Text: truncateRunes(title, slackMaxHeaderText)}},
+			section,
+		},
+	}
+}
+
+type lineMessage struct {
+	Type               string `json:"type"`
+	Text               string `json:"text,omitempty"`
+	OriginalContentURL string `json:"originalContentUrl,omitempty"`
+	PreviewImageURL    string `json:"previewImageUrl,omitempty"`
+}
 
-		notify(ctx, p, msg, url)
+func postLine(ctx context.Context, cli *lineClient, msg string, item *Item) error {
+	var messages []lineMessage
+	if item.ImageURL != "" {
+		messages = append(messages, lineMessage{
+			Type:               "image",
+			OriginalContentURL: item.ImageURL,
+			PreviewImageURL:    item.ImageURL,
+		})
 	}
-}
+	messages = append(messages, lineMessage{
+		Type: "text",
+		Text: msg,
+	})
 
-func itemFindByURL(ctx context.Context, db *bun.DB, url string) *Item {
-	dbItem := new(Item)
-	_ = db.NewSelect().Model(dbItem).Where("url = ?", url).Scan(ctx)
+	endpoint := "https://api.line.me/v2/bot/message/broadcast"
+	payload := map[string]any{"messages": messages}
+	if cli.to != "" {
+		endpoint = "https://api.line.me/v2/bot/message/push"
+		payload["to"] = cli.to
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+cli.token)
+	return postJSON(ctx, endpoint, header, payload)
+}
 
-	return dbItem
+func postTelegram(ctx context.Context, cli *telegramClient, msg string, item *Item) error {
+	endpoint := "https://api.telegram.org/bot" + cli.token
+	// Captions are limited to 1024 characters, so long messages go out as plain text.
+	if item.ImageURL != "" && len([]rune(msg)) <= 1024 {
+		err := postJSON(ctx, endpoint+"/sendPhoto", nil, map[string]string{
+			"chat_id": cli.chatID,
+			"photo":   item.ImageURL,
+			"caption": msg,
+		})
+		if err == nil {
+			return nil
+		}
+		slog.Warn("telegram sendPhoto failed, falling back to sendMessage", "url", item.URL, "error", err)
+	}
+	return postJSON(ctx, endpoint+"/sendMessage", nil, map[string]string{
+		"chat_id": cli.chatID,
+		"text":    msg,
+	})
 }
 
-func insert(ctx context.Context, db *bun.DB, item *Item) error {
-	_, err := db.NewInsert().Model(item).Exec(ctx)
+// postJSON posts payload as JSON to endpoint and fails on any non-200 response.
+func postJSON(ctx context.Context, endpoint string, header http.Header, payload any) error {
+	body, err := json.Marshal(payload)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	return nil
-}
 
-func update(ctx context.Context, db *bun.DB, item *Item) error {
-	_, err := db.NewUpdate().Model(item).WherePK().Exec(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, b)
+	}
 	return nil
 }
 
-func notify(ctx context.Context, p NotifyParams, msg, url string) {
-	if p.tCli != nil && !debug {
-		tweet(p.tCli, msg+"\n\n#booth_pm #東方デジタル音楽\n#東方Project #東方楽曲 #東方アレンジ")
-	}
-	if p.dCli != nil && p.channelID != "" {
-		sendMessage(p.dCli, p.channelID, msg)
+// postBluesky posts text as a thread when it exceeds Bluesky's grapheme
+// limit. The embed goes on the first post; each later post replies to the
+// previous one. Every post in the thread carries opts.labels as self-labels.
+func postBluesky(ctx context.Context, cli *blueskyClient, text string, item *Item, opts blueskyPostOptions) error {
+	lang := "ja"
+	var shopDID string
+	if item != nil {
+		lang = detectLang(item.Name + "\n" + item.Description)
+		shopDID = resolveShopDID(ctx, cli, opts.shopHandles, item.ShopName)
 	}
-	if p.bCli != nil {
-		postBluesky(ctx, p.bCli, msg+"\n\n#booth_pm #東方デジタル音楽\n#東方Project #東方楽曲 #東方アレンジ", url)
+	var root, parent *atproto.RepoStrongRef
+	for i, part := range splitBlueskyText(text) {
+		post := &bsky.FeedPost{
+			Text:      part,
+			CreatedAt: time.Now().Local().Format(time.RFC3339),
+			Langs:     []string{lang},
+			Facets:    blueskyFacets(part, item, shopDID),
+		}
+		if len(opts.labels) > 0 {
+			selfLabels := &atproto.LabelDefs_SelfLabels{}
+			for _, l := range opts.labels {
+				selfLabels.Values = append(selfLabels.Values, &atproto.LabelDefs_SelfLabel{Val: l})
+			}
+			post.Labels = &bsky.FeedPost_Labels{LabelDefs_SelfLabels: selfLabels}
+		}
+		if i > 0 {
+			post.Reply = &bsky.FeedPost_ReplyRef{Root: root, Parent: parent}
+		} else if item != nil {
+			post.Embed = &bsky.FeedPost_Embed{}
+			addBlueskyEmbed(ctx, cli, post, item, opts.imageEmbed)
+		}
+
+		ref, err := createBlueskyPost(ctx, cli, post)
+		if err != nil {
+			if i > 0 {
+				return fmt.Errorf("thread post %d: %w", i+1, err)
+			}
+			return err
+		}
+		if root == nil {
+			root = ref
+		}
+		parent = ref
 	}
+	return nil
 }
 
-func tweet(cli *twitter.Client, msg string) {
-	_, _, err := cli.Statuses.Update(msg, nil)
-	if err != nil {
-		log.Printf("tweet error: %s", err)
+// blueskyPostOptions are the settings postBluesky applies to a post.
+type blueskyPostOptions struct {
+	// imageEmbed embeds the item image instead of a link card.
+	imageEmbed bool
+	labels     []string
+	// shopHandles maps shop names to the Bluesky handles to mention.
+	shopHandles map[string]string
+}
+
+// blueskyLabels returns the self-labels for a post about item: the adult
+// labels for adult items and none otherwise.
+func blueskyLabels(p NotifyParams, item *Item) []string {
+	if item.Adult {
+		return p.bAdultLabels
 	}
+	return nil
 }
 
-func sendMessage(s *discordgo.Session, channelID, msg string) {
-	_, err := s.ChannelMessageSend(channelID, msg)
-	if err != nil {
-		log.Println("Error sending message: ", err)
+// detectLang guesses the language of text from its scripts: kana means
+// Japanese, Hangul Korean, and Latin letters with no CJK at all English.
+// Anything else, including kanji-only text, is treated as Japanese.
+func detectLang(text string) string {
+	var kana, hangul, han, latin int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
 	}
+	switch {
+	case kana > 0:
+		return "ja"
+	case hangul > 0:
+		return "ko"
+	case han == 0 && latin > 0:
+		return "en"
+	}
+	return "ja"
 }
 
-func postBluesky(ctx context.Context, cli *xrpc.Client, text, url string) {
-	post := &bsky.FeedPost{
-		Text:      text,
-		CreatedAt: time.Now().Local().Format(time.RFC3339),
-		Langs:     []string{"ja"},
-		Embed:     &bsky.FeedPost_Embed{},
+func addBlueskyEmbed(ctx context.Context, cli *blueskyClient, post *bsky.FeedPost, item *Item, imageEmbed bool) {
+	if imageEmbed {
+		images, err := uploadImageEmbed(ctx, cli, item.ImageURL, item.Name)
+		if err != nil {
+			slog.Warn("uploading image to bluesky failed, falling back to link card", "url", item.URL, "error", err)
+			addLink(ctx, cli, post, item)
+		} else {
+			post.Embed.EmbedImages = images
+		}
+	} else {
+		addLink(ctx, cli, post, item)
 	}
-	addLink(cli, post, url)
+}
 
-	for _, entry := range extractTagsBytes(text) {
-		post.Facets = append(post.Facets, &bsky.RichtextFacet{
+// blueskyFacets returns the tag, link and shop facets for text. The shop name
+// mentions shopDID when it is set, and otherwise links to the BOOTH shop page.
+func blueskyFacets(text string, item *Item, shopDID string) []*bsky.RichtextFacet {
+	var facets []*bsky.RichtextFacet
+	tags := extractTagsBytes(text)
+	links := extractLinksBytes(text)
+	for _, entry := range tags {
+		facets = append(facets, &bsky.RichtextFacet{
 			Features: []*bsky.RichtextFacet_Features_Elem{
 				{
 					RichtextFacet_Tag: &bsky.RichtextFacet_Tag{
@@ -381,8 +4005,8 @@ func postBluesky(ctx context.Context, cli *xrpc.Client, text, url string) {
 		})
 	}
 
-	for _, entry := range extractLinksBytes(text) {
-		post.Facets = append(post.Facets, &bsky.RichtextFacet{
+	for _, entry := range links {
+		facets = append(facets, &bsky.RichtextFacet{
 			Features: []*bsky.RichtextFacet_Features_Elem{
 				{
 					RichtextFacet_Link: &bsky.RichtextFacet_Link{
@@ -397,6 +4021,54 @@ func postBluesky(ctx context.Context, cli *xrpc.Client, text, url string) {
 		})
 	}
 
+	if item == nil || item.ShopName == "" {
+		return facets
+	}
+	var feature *bsky.RichtextFacet_Features_Elem
+	if shopDID != "" {
+		feature = &bsky.RichtextFacet_Features_Elem{
+			RichtextFacet_Mention: &bsky.RichtextFacet_Mention{
+				Did: shopDID,
+			},
+		}
+	} else if item.ShopURL != "" {
+		feature = &bsky.RichtextFacet_Features_Elem{
+			RichtextFacet_Link: &bsky.RichtextFacet_Link{
+				Uri: item.ShopURL,
+			},
+		}
+	}
+	if feature == nil {
+		return facets
+	}
+	if i := shopNameIndex(text, item.ShopName, append(tags, links...)); i >= 0 {
+		facets = append(facets, &bsky.RichtextFacet{
+			Features: []*bsky.RichtextFacet_Features_Elem{feature},
+			Index: &bsky.RichtextFacet_ByteSlice{
+				ByteStart: int64(i),
+				ByteEnd:   int64(i + len(item.ShopName)),
+			},
+		})
+	}
+	return facets
+}
+
+// shopNameIndex returns the byte offset of the last occurrence of name in text
+// that overlaps none of entries, or -1. Facets must not overlap, and the
+// hashtag block can contain a shop name too, e.g. "東方Project".
+func shopNameIndex(text, name string, entries []entry) int {
+	for end := len(text); ; {
+		i := strings.LastIndex(text[:end], name)
+		if i < 0 || !overlapsAny(int64(i), int64(i+len(name)), entries) {
+			return i
+		}
+		end = i
+	}
+}
+
+// createBlueskyPost creates post in the session's repo and returns a reference
+// that replies can point at.
+func createBlueskyPost(ctx context.Context, cli *blueskyClient, post *bsky.FeedPost) (*atproto.RepoStrongRef, error) {
 	input := &atproto.RepoCreateRecord_Input{
 		Collection: "app.bsky.feed.post",
 		Repo:       cli.Auth.Did,
@@ -405,10 +4077,132 @@ func postBluesky(ctx context.Context, cli *xrpc.Client, text, url string) {
 		},
 	}
 
-	_, err := atproto.RepoCreateRecord(ctx, cli, input)
+	var out *atproto.RepoCreateRecord_Output
+	err := cli.withRetry(ctx, "createRecord", func() error {
+		var err error
+		out, err = atproto.RepoCreateRecord(ctx, cli.Client, input)
+		if isExpiredTokenError(err) {
+			if err = refreshBlueskySession(ctx, cli.Client); err == nil {
+				out, err = atproto.RepoCreateRecord(ctx, cli.Client, input)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &atproto.RepoStrongRef{Uri: out.Uri, Cid: out.Cid}, nil
+}
+
+// resolveShopDID returns the DID of shopName's Bluesky account from handles,
+// or "" when the shop has no mapping or the handle does not resolve.
+func resolveShopDID(ctx context.Context, cli *blueskyClient, handles map[string]string, shopName string) string {
+	handle, ok := handles[shopName]
+	if !ok {
+		return ""
+	}
+	var out *atproto.IdentityResolveHandle_Output
+	err := cli.withRetry(ctx, "resolveHandle", func() error {
+		var err error
+		out, err = atproto.IdentityResolveHandle(ctx, cli.Client, strings.TrimPrefix(handle, "@"))
+		return err
+	})
+	if err != nil {
+		slog.Warn("resolving shop bluesky handle failed", "shop", shopName, "handle", handle, "error", err)
+		return ""
+	}
+	return out.Did
+}
+
+// withRetry runs fn, retrying with backoff up to c.retryCount times while it
+// fails with a transient error such as a 5xx from the PDS.
+func (c *blueskyClient) withRetry(ctx context.Context, op string, fn func() error) error {
+	err := fn()
+	for i := 0; isRetryableBlueskyError(err) && i < c.retryCount; i++ {
+		wait := time.Duration(1<<i) * time.Second
+		wait += time.Duration(rand.Int63n(int64(wait / 2)))
+		slog.Warn("bluesky request failed, retrying", "op", op, "error", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		err = fn()
+	}
+	return err
+}
+
+func isRetryableBlueskyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var xe *xrpc.Error
+	if errors.As(err, &xe) {
+		return xe.StatusCode >= http.StatusInternalServerError || xe.StatusCode == http.StatusTooManyRequests
+	}
+	// Transport errors such as timeouts or reset connections are worth another try.
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// splitBlueskyText breaks text into posts of at most blueskyMaxGraphemes
+// graphemes, preferring line boundaries and only cutting inside a line that is
+// longer than the limit.
+func splitBlueskyText(text string) []string {
+	var parts []string
+	var cur []string
+	flush := func() {
+		if part := strings.Trim(strings.Join(cur, ""), "\n"); part != "" {
+			parts = append(parts, part)
+		}
+		cur = nil
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		var clusters []string
+		gr := uniseg.NewGraphemes(line)
+		for gr.Next() {
+			clusters = append(clusters, gr.Str())
+		}
+		if len(cur)+len(clusters) > blueskyMaxGraphemes {
+			flush()
+		}
+		for len(clusters) > blueskyMaxGraphemes {
+			cur = clusters[:blueskyMaxGraphemes]
+			flush()
+			clusters = clusters[blueskyMaxGraphemes:]
+		}
+		cur = append(cur, clusters...)
+	}
+	flush()
+	return parts
+}
+
+func isExpiredTokenError(err error) bool {
+	var xe *xrpc.XRPCError
+	return errors.As(err, &xe) && xe.ErrStr == "ExpiredToken"
+}
+
+func refreshBlueskySession(ctx context.Context, cli *xrpc.Client) error {
+	// refreshSession must be authorized with the refresh token instead of the access token.
+	refreshCli := &xrpc.Client{
+		Client: cli.Client,
+		Host:   cli.Host,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt: cli.Auth.RefreshJwt,
+		},
+	}
+	output, err := atproto.ServerRefreshSession(ctx, refreshCli)
 	if err != nil {
-		log.Println("Error posting to bluesky: ", err)
+		return err
+	}
+	cli.Auth = &xrpc.AuthInfo{
+		AccessJwt:  output.AccessJwt,
+		RefreshJwt: output.RefreshJwt,
+		Handle:     output.Handle,
+		Did:        output.Did,
 	}
+	slog.Info("bluesky session refreshed", "handle", output.Handle)
+	return nil
 }
 
 type entry struct {
@@ -419,17 +4213,32 @@ type entry struct {
 
 func extractTagsBytes(text string) []entry {
 	var result []entry
+	links := extractLinksBytes(text)
 	matches := tagRe.FindAllStringSubmatchIndex(text, -1)
 	for _, m := range matches {
+		// m[2]:m[3] is the tag itself, without the leading whitespace.
+		start, end := int64(m[2]), int64(m[3])
+		if overlapsAny(start, end, links) {
+			continue
+		}
 		result = append(result, entry{
-			text:  strings.TrimPrefix(text[m[0]:m[1]], "#"),
-			start: int64(len(text[0:m[0]])),
-			end:   int64(len(text[0:m[1]]))},
+			text:  strings.TrimPrefix(text[m[2]:m[3]], "#"),
+			start: start,
+			end:   end},
 		)
 	}
 	return result
 }
 
+func overlapsAny(start, end int64, entries []entry) bool {
+	for _, e := range entries {
+		if start < e.end && e.start < end {
+			return true
+		}
+	}
+	return false
+}
+
 func extractLinksBytes(text string) []entry {
 	var result []entry
 	matches := linkRe.FindAllStringSubmatchIndex(text, -1)
@@ -443,77 +4252,359 @@ func extractLinksBytes(text string) []entry {
 	return result
 }
 
-func addLink(xrpcc *xrpc.Client, post *bsky.FeedPost, link string) {
-	res, _ := http.Get(link)
-	if res != nil {
-		defer res.Body.Close()
+func addLink(ctx context.Context, cli *blueskyClient, post *bsky.FeedPost, item *Item) {
+	link := item.URL
+	// Prefer the item's own name and shop over the bare link when meta tags are missing.
+	fallbackTitle := item.Name
+	if fallbackTitle == "" {
+		fallbackTitle = link
+	}
+	fallbackDescription := item.ShopName
+	if fallbackDescription == "" {
+		fallbackDescription = link
+	}
+
+	post.Embed.EmbedExternal = &bsky.EmbedExternal{
+		External: &bsky.EmbedExternal_External{
+			Description: fallbackDescription,
+			Title:       fallbackTitle,
+			Uri:         link,
+		},
+	}
+
+	doc, err := itemPages.get(ctx, link)
+	if err != nil {
+		slog.Warn("fetching link card page failed", "url", link, "error", err)
+		return
+	}
+
+	title := doc.Find(`title`).Text()
+	description := truncateGraphemes(item.Description, cardDescriptionMaxGraphemes)
+	if description == "" {
+		description = pageDescription(doc)
+	}
+	imgURL, _ := doc.Find(`meta[property="og:image"]`).Attr("content")
+	if title == "" {
+		title, _ = doc.Find(`meta[property="og:title"]`).Attr("content")
+		if title == "" {
+			title = fallbackTitle
+		}
+	}
+	if description == "" {
+		description = fallbackDescription
+	}
+	post.Embed.EmbedExternal.External.Title = title
+	post.Embed.EmbedExternal.External.Description = description
+
+	if imgURL != "" {
+		// A failed or rejected thumbnail only drops the thumbnail, never the post.
+		thumb, err := uploadImageBlob(ctx, cli, imgURL)
+		if err != nil {
+			slog.Warn("attaching thumbnail failed", "url", imgURL, "error", err)
+		} else {
+			post.Embed.EmbedExternal.External.Thumb = thumb
+		}
+	}
+}
+
+// pageCache holds item pages fetched during one pass, so description
+// extraction and the Bluesky link card share a single request.
+type pageCache struct {
+	mu    sync.Mutex
+	pages map[string]*goquery.Document
+}
+
+var itemPages = &pageCache{}
+
+func (c *pageCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = nil
+}
+
+func (c *pageCache) get(ctx context.Context, u string) (*goquery.Document, error) {
+	c.mu.Lock()
+	doc, ok := c.pages[u]
+	c.mu.Unlock()
+	if ok {
+		return doc, nil
+	}
+
+	doc, err := fetchDocument(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pages == nil {
+		c.pages = make(map[string]*goquery.Document)
+	}
+	c.pages[u] = doc
+	return doc, nil
+}
+
+// fetchDocument GETs u and parses it as HTML, decoding non-UTF-8 pages.
+func fetchDocument(ctx context.Context, u string) (*goquery.Document, error) {
+	res, err := httpGet(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", u, res.Status)
+	}
 
-		br := bufio.NewReader(res.Body)
-		var reader io.Reader = br
+	br := bufio.NewReader(res.Body)
+	var reader io.Reader = br
 
-		data, err2 := br.Peek(1024)
-		if err2 == nil {
-			enc, name, _ := charset.DetermineEncoding(data, res.Header.Get("content-type"))
+	data, err := br.Peek(1024)
+	if err == nil || errors.Is(err, io.EOF) {
+		enc, name, _ := charset.DetermineEncoding(data, res.Header.Get("content-type"))
+		if enc != nil {
+			reader = enc.NewDecoder().Reader(br)
+		} else if len(name) > 0 {
+			enc := encoding.GetEncoding(name)
 			if enc != nil {
 				reader = enc.NewDecoder().Reader(br)
-			} else if len(name) > 0 {
-				enc := encoding.GetEncoding(name)
-				if enc != nil {
-					reader = enc.NewDecoder().Reader(br)
-				}
 			}
 		}
+	}
 
-		var title string
-		var description string
-		var imgURL string
-		doc, err := goquery.NewDocumentFromReader(reader)
-		if err == nil {
-			title = doc.Find(`title`).Text()
-			description, _ = doc.Find(`meta[property="description"]`).Attr("content")
-			imgURL, _ = doc.Find(`meta[property="og:image"]`).Attr("content")
-			if title == "" {
-				title, _ = doc.Find(`meta[property="og:title"]`).Attr("content")
-				if title == "" {
-					title = link
-				}
-			}
-			if description == "" {
-				description, _ = doc.Find(`meta[property="og:description"]`).Attr("content")
-				if description == "" {
-					description = link
-				}
-			}
-			post.Embed.EmbedExternal = &bsky.EmbedExternal{
-				External: &bsky.EmbedExternal_External{
-					Description: description,
-					Title:       title,
-					Uri:         link,
-				},
-			}
-		} else {
-			post.Embed.EmbedExternal = &bsky.EmbedExternal{
-				External: &bsky.EmbedExternal_External{
-					Uri: link,
-				},
-			}
+	return goquery.NewDocumentFromReader(reader)
+}
+
+// fetchItemJSON decodes BOOTH's JSON representation of the item page itemURL
+// into v. The request goes through a collector paced like the search pages.
+func fetchItemJSON(ctx context.Context, opts ScrapeOptions, itemURL string, v any) error {
+	c, err := newBoothCollector(ctx, opts)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	c.OnResponse(func(r *colly.Response) {
+		body = r.Body
+	})
+	if err := visitWithRetry(ctx, c, itemURL+".json", opts.RetryCount); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// fetchPublishedAt reads when the item was published from BOOTH's JSON
+// representation of the item page.
+func fetchPublishedAt(ctx context.Context, opts ScrapeOptions, itemURL string) (time.Time, error) {
+	var v struct {
+		PublishedAt time.Time `json:"published_at"`
+	}
+	if err := fetchItemJSON(ctx, opts, itemURL, &v); err != nil {
+		return time.Time{}, err
+	}
+	return v.PublishedAt, nil
+}
+
+// scrapeItemDetail fills item's description, tags, images and release time
+// from BOOTH's item JSON.
+func scrapeItemDetail(ctx context.Context, opts ScrapeOptions, item *Item) error {
+	var v struct {
+		Description string    `json:"description"`
+		PublishedAt time.Time `json:"published_at"`
+		IsAdult     bool      `json:"is_adult"`
+		Tags        []struct {
+			Name string `json:"name"`
+		} `json:"tags"`
+		Images []struct {
+			Original string `json:"original"`
+		} `json:"images"`
+	}
+	if err := fetchItemJSON(ctx, opts, item.URL, &v); err != nil {
+		return err
+	}
+	item.Description = strings.TrimSpace(v.Description)
+	item.PublishedAt = v.PublishedAt
+	item.Adult = item.Adult || v.IsAdult
+	for _, t := range v.Tags {
+		item.Tags = append(item.Tags, t.Name)
+	}
+	for _, img := range v.Images {
+		if img.Original != "" {
+			item.Images = append(item.Images, img.Original)
 		}
-		if imgURL != "" && post.Embed.EmbedExternal != nil {
-			resp, err := http.Get(imgURL)
-			if err == nil && resp.StatusCode == http.StatusOK {
-				defer resp.Body.Close()
-				b, err := io.ReadAll(resp.Body)
-				if err == nil {
-					resp, err := comatproto.RepoUploadBlob(context.TODO(), xrpcc, bytes.NewReader(b))
-					if err == nil {
-						post.Embed.EmbedExternal.External.Thumb = &lexutil.LexBlob{
-							Ref:      resp.Blob.Ref,
-							MimeType: http.DetectContentType(b),
-							Size:     resp.Blob.Size,
-						}
-					}
-				}
-			}
+	}
+	return nil
+}
+
+// fetchDescription returns the item's summary from its page meta tags, or an
+// empty string when the page can't be fetched.
+func fetchDescription(ctx context.Context, u string) string {
+	doc, err := itemPages.get(ctx, u)
+	if err != nil {
+		slog.Warn("fetching item page failed", "url", u, "error", err)
+		return ""
+	}
+	return pageDescription(doc)
+}
+
+// pageDescription returns the page's description meta tag, falling back to og:description.
+func pageDescription(doc *goquery.Document) string {
+	description, _ := doc.Find(`meta[name="description"]`).Attr("content")
+	if description == "" {
+		description, _ = doc.Find(`meta[property="og:description"]`).Attr("content")
+	}
+	return strings.TrimSpace(description)
+}
+
+func truncateGraphemes(s string, n int) string {
+	if uniseg.GraphemeClusterCount(s) <= n {
+		return s
+	}
+	var b strings.Builder
+	gr := uniseg.NewGraphemes(s)
+	for i := 0; i < n-1 && gr.Next(); i++ {
+		b.WriteString(gr.Str())
+	}
+	return b.String() + "…"
+}
+
+func uploadImageEmbed(ctx context.Context, cli *blueskyClient, imageURL, alt string) (*bsky.EmbedImages, error) {
+	blob, err := uploadImageBlob(ctx, cli, imageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bsky.EmbedImages{
+		Images: []*bsky.EmbedImages_Image{
+			{
+				Alt:   alt,
+				Image: blob,
+			},
+		},
+	}, nil
+}
+
+// blueskyImageTypes are the image formats Bluesky accepts as blobs.
+var blueskyImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// uploadImageBlob fetches imageURL and uploads it as a blob after checking its
+// type and size. A blob already uploaded for imageURL during this pass is reused.
+func uploadImageBlob(ctx context.Context, cli *blueskyClient, imageURL string) (*lexutil.LexBlob, error) {
+	if blob := uploadedBlobs.get(imageURL); blob != nil {
+		return blob, nil
+	}
+
+	resp, err := httpGet(ctx, imageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", imageURL, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxImageFetchSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxImageFetchSize {
+		return nil, fmt.Errorf("image %s exceeds %d bytes", imageURL, maxImageFetchSize)
+	}
+	mimeType := http.DetectContentType(b)
+	if !slices.Contains(blueskyImageTypes, mimeType) {
+		return nil, fmt.Errorf("unsupported image type %s for %s", mimeType, imageURL)
+	}
+	if len(b) > blueskyMaxBlobSize {
+		b, err = shrinkImage(b, blueskyMaxBlobSize)
+		if err != nil {
+			return nil, fmt.Errorf("shrinking %s: %w", imageURL, err)
+		}
+		mimeType = "image/jpeg"
+	}
+
+	var out *comatproto.RepoUploadBlob_Output
+	err = cli.withRetry(ctx, "uploadBlob", func() error {
+		var err error
+		out, err = comatproto.RepoUploadBlob(ctx, cli.Client, bytes.NewReader(b))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	blob := &lexutil.LexBlob{
+		Ref:      out.Blob.Ref,
+		MimeType: mimeType,
+		Size:     out.Blob.Size,
+	}
+	uploadedBlobs.put(imageURL, blob)
+	return blob, nil
+}
+
+// blobCache holds the blobs uploaded during one pass by image URL, so posting
+// the same image again, e.g. for a retry or a second update, skips the upload.
+type blobCache struct {
+	mu    sync.Mutex
+	blobs map[string]*lexutil.LexBlob
+}
+
+var uploadedBlobs = &blobCache{}
+
+func (c *blobCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs = nil
+}
+
+func (c *blobCache) get(imageURL string) *lexutil.LexBlob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blobs[imageURL]
+}
+
+func (c *blobCache) put(imageURL string, blob *lexutil.LexBlob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blobs == nil {
+		c.blobs = make(map[string]*lexutil.LexBlob)
+	}
+	c.blobs[imageURL] = blob
+}
+
+// shrinkImage re-encodes a JPEG or PNG image as a JPEG no larger than maxSize,
+// scaling it down to imageMaxDimension and lowering the quality as needed.
+func shrinkImage(b []byte, maxSize int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if longest := max(w, h); longest > imageMaxDimension {
+		w = w * imageMaxDimension / longest
+		h = h * imageMaxDimension / longest
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	for _, quality := range []int{85, 70, 55, 40} {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
 		}
+		if buf.Len() <= maxSize {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("still %d bytes after re-encoding", buf.Len())
+}
+
+func httpGet(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("User-Agent", userAgent)
+	return httpClient.Do(req)
 }
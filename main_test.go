@@ -0,0 +1,792 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bwmarrin/discordgo"
+	"github.com/shopspring/decimal"
+)
+
+const emptyResultPage = `<html><body><ul class="l-cards"></ul></body></html>`
+
+// newBoothServer serves pages as consecutive search result pages of every
+// query; the pages after them are empty.
+func newBoothServer(t *testing.T, pages ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := 1
+		if v := r.URL.Query().Get("page"); v != "" {
+			page, _ = strconv.Atoi(v)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if page >= 1 && page <= len(pages) {
+			io.WriteString(w, pages[page-1])
+			return
+		}
+		io.WriteString(w, emptyResultPage)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCard is the markup of one BOOTH item card.
+type testCard struct {
+	href, name, shop, shopHref, image, price string
+}
+
+func (c testCard) html() string {
+	// An empty price leaves out the attribute altogether.
+	var price string
+	if c.price != "" {
+		price = fmt.Sprintf(` data-product-price="%s"`, c.price)
+	}
+	return fmt.Sprintf(`<li class="item-card"%s><div class="item-card__wrap">`+
+		`<div class="item-card__thumbnail"><img src="%s"></div>`+
+		`<div class="item-card__category">音楽</div>`+
+		`<div class="item-card__title"><a href="%s">%s</a></div>`+
+		`<div class="item-card__shop-name"><a href="%s">%s</a></div>`+
+		`<div class="price">¥ %s</div></div></li>`,
+		price, c.image, c.href, c.name, c.shopHref, c.shop, c.price)
+}
+
+// resultPage renders cards as a search result page.
+func resultPage(cards ...testCard) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><ul class="l-cards">`)
+	for _, c := range cards {
+		b.WriteString(c.html())
+	}
+	b.WriteString(`</ul></body></html>`)
+	return b.String()
+}
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// scrapeFixture runs getItems for queries against srv.
+func scrapeFixture(t *testing.T, srv *httptest.Server, queries ...SearchQuery) []*Item {
+	t.Helper()
+	if len(queries) == 0 {
+		queries = []SearchQuery{defaultSearchQuery}
+	}
+	opts := ScrapeOptions{
+		MaxPages:    defaultMaxPages,
+		BaseURL:     srv.URL,
+		Locale:      defaultBoothLocale,
+		Concurrency: 1,
+	}
+	items, err := getItems(context.Background(), queries, opts)
+	if err != nil {
+		t.Fatalf("getItems: %v", err)
+	}
+	return items
+}
+
+func TestGetItems(t *testing.T) {
+	srv := newBoothServer(t, readFixture(t, "search.html"))
+	items := scrapeFixture(t, srv)
+
+	type scraped struct {
+		Name, Category, Price, URL, ImageURL, ShopName string
+		Stock                                          bool
+	}
+	want := []scraped{
+		{
+			Name:     "幻想郷アレンジ集",
+			Category: "音楽",
+			Price:    "1000",
+			URL:      "https://booth.pm/ja/items/5123456",
+			ImageURL: "https://booth.pximg.net/c/300x300_a2_g5/5123456/a1b2c3d4_base_resized.jpg",
+			ShopName: "幻想郷サウンド",
+			Stock:    true,
+		},
+		{
+			Name:     "紅魔館ピアノ",
+			Category: "音楽",
+			Price:    "500",
+			URL:      "https://booth.pm/ja/items/5123457",
+			ImageURL: "https://booth.pximg.net/c/300x300_a2_g5/5123457/e5f6a7b8_base_resized.jpg",
+			ShopName: "スカーレットキーズ",
+			Stock:    false,
+		},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for i, w := range want {
+		it := items[i]
+		got := scraped{it.Name, it.Category, it.Price, it.URL, it.ImageURL, it.ShopName, it.Stock}
+		if got != w {
+			t.Errorf("item %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestGetItemsDeduplicatesByURL(t *testing.T) {
+	page := readFixture(t, "search.html")
+
+	t.Run("across pages", func(t *testing.T) {
+		srv := newBoothServer(t, page, page)
+		items := scrapeFixture(t, srv)
+		assertUniqueURLs(t, items, 2)
+	})
+
+	t.Run("across queries", func(t *testing.T) {
+		srv := newBoothServer(t, page)
+		other := defaultSearchQuery
+		other.Keyword = "東方アレンジ"
+		items := scrapeFixture(t, srv, defaultSearchQuery, other)
+		assertUniqueURLs(t, items, 2)
+		for _, item := range items {
+			if item.Query.Keyword != defaultSearchQuery.Keyword {
+				t.Errorf("%s kept from query %q, want the first query's", item.URL, item.Query.Keyword)
+			}
+		}
+	})
+}
+
+func assertUniqueURLs(t *testing.T, items []*Item, want int) {
+	t.Helper()
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if seen[item.URL] {
+			t.Errorf("duplicate item %s", item.URL)
+		}
+		seen[item.URL] = true
+	}
+	if len(items) != want {
+		t.Errorf("got %d items, want %d", len(items), want)
+	}
+}
+
+func TestExcludeKeywords(t *testing.T) {
+	t.Setenv("EXCLUDE_KEYWORDS", " 楽譜 , グッズ,,")
+	f, err := loadItemFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		item Item
+		want string
+	}{
+		{"keyword in name", Item{Name: "東方ピアノ楽譜集", ShopName: "幻想郷サウンド"}, "excluded keyword"},
+		{"keyword in shop name", Item{Name: "幻想郷アレンジ集", ShopName: "東方グッズ工房"}, "excluded keyword"},
+		{"no keyword", Item{Name: "幻想郷アレンジ集", ShopName: "幻想郷サウンド"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.skipReason(&tt.item); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetItemsSkipsSheetMusicShops(t *testing.T) {
+	srv := newBoothServer(t, resultPage(
+		testCard{href: "https://booth.pm/ja/items/1", name: "東方ピアノ譜", shop: "楽譜屋さん", image: "https://booth.pximg.net/1.jpg", price: "800"},
+		testCard{href: "https://booth.pm/ja/items/2", name: "幻想郷アレンジ集", shop: "幻想郷サウンド", image: "https://booth.pximg.net/2.jpg", price: "1000"},
+	))
+	items := scrapeFixture(t, srv)
+
+	if len(items) != 1 {
+		t.Fatalf("got %d items, want 1", len(items))
+	}
+	if items[0].ShopName != "幻想郷サウンド" {
+		t.Errorf("kept item from %q, want 幻想郷サウンド", items[0].ShopName)
+	}
+}
+
+func TestGetItemsResolvesRelativeURLs(t *testing.T) {
+	srv := newBoothServer(t, resultPage(
+		testCard{href: "/ja/items/12345", name: "幻想郷アレンジ集", shop: "幻想郷サウンド", shopHref: "/shops/gensokyo", image: "/images/12345.jpg", price: "1000"},
+	))
+	items := scrapeFixture(t, srv)
+
+	if len(items) != 1 {
+		t.Fatalf("got %d items, want 1", len(items))
+	}
+	item := items[0]
+	if want := srv.URL + "/ja/items/12345"; item.URL != want {
+		t.Errorf("URL = %q, want %q", item.URL, want)
+	}
+	if want := srv.URL + "/shops/gensokyo"; item.ShopURL != want {
+		t.Errorf("ShopURL = %q, want %q", item.ShopURL, want)
+	}
+	if want := srv.URL + "/images/12345.jpg"; item.ImageURL != want {
+		t.Errorf("ImageURL = %q, want %q", item.ImageURL, want)
+	}
+}
+
+func TestFacetByteOffsets(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		tags  []entry
+		links []entry
+	}{
+		{
+			name: "tag in Japanese text",
+			text: "新着です #東方Project の新譜",
+			tags: []entry{{start: 13, end: 27, text: "東方Project"}},
+		},
+		{
+			name: "multiple tags",
+			text: "#booth_pm #東方デジタル音楽\n#東方Project #東方楽曲",
+			tags: []entry{
+				{start: 0, end: 9, text: "booth_pm"},
+				{start: 10, end: 35, text: "東方デジタル音楽"},
+				{start: 36, end: 50, text: "東方Project"},
+				{start: 51, end: 64, text: "東方楽曲"},
+			},
+		},
+		{
+			name:  "URL mid-string",
+			text:  "詳細は https://booth.pm/ja/items/5123456 をチェック",
+			links: []entry{{start: 10, end: 43, text: "https://booth.pm/ja/items/5123456"}},
+		},
+		{
+			name:  "tag next to a link",
+			text:  "#東方アレンジ https://booth.pm/ja/items/5123456",
+			tags:  []entry{{start: 0, end: 19, text: "東方アレンジ"}},
+			links: []entry{{start: 20, end: 53, text: "https://booth.pm/ja/items/5123456"}},
+		},
+		{
+			name: "emoji before a tag",
+			text: "🆕新着🆕 #東方アレンジ",
+			tags: []entry{{start: 15, end: 34, text: "東方アレンジ"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertEntries(t, "tags", tt.text, extractTagsBytes(tt.text), tt.tags, "#")
+			assertEntries(t, "links", tt.text, extractLinksBytes(tt.text), tt.links, "")
+		})
+	}
+}
+
+// assertEntries checks got against want and that each entry's offsets cover
+// prefix+text in the UTF-8 bytes of text.
+func assertEntries(t *testing.T, kind, text string, got, want []entry, prefix string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s = %+v, want %+v", kind, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s[%d] = %+v, want %+v", kind, i, got[i], want[i])
+		}
+		if got[i].start < 0 || got[i].start > got[i].end || got[i].end > int64(len(text)) {
+			t.Errorf("%s[%d] offsets %d:%d out of range", kind, i, got[i].start, got[i].end)
+		} else if s := text[got[i].start:got[i].end]; s != prefix+got[i].text {
+			t.Errorf("%s[%d] covers %q, want %q", kind, i, s, prefix+got[i].text)
+		}
+	}
+}
+
+func TestURLFragmentIsNotTag(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		tags  []entry
+		links []entry
+	}{
+		{
+			name:  "fragment followed by a tag",
+			text:  "詳細 https://booth.pm/ja/items/5123456#description #東方",
+			tags:  []entry{{start: 53, end: 60, text: "東方"}},
+			links: []entry{{start: 7, end: 52, text: "https://booth.pm/ja/items/5123456#description"}},
+		},
+		{
+			name:  "several hashes in one URL",
+			text:  "https://booth.pm/ja/items/5123456#a#b",
+			links: []entry{{start: 0, end: 37, text: "https://booth.pm/ja/items/5123456#a#b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertEntries(t, "tags", tt.text, extractTagsBytes(tt.text), tt.tags, "#")
+			assertEntries(t, "links", tt.text, extractLinksBytes(tt.text), tt.links, "")
+		})
+	}
+}
+
+func TestGetItemsPrices(t *testing.T) {
+	srv := newBoothServer(t, resultPage(
+		testCard{href: "https://booth.pm/ja/items/1", name: "価格なし", shop: "幻想郷サウンド", image: "https://booth.pximg.net/1.jpg"},
+		testCard{href: "https://booth.pm/ja/items/2", name: "幻想郷アレンジ集", shop: "幻想郷サウンド", image: "https://booth.pximg.net/2.jpg", price: "01000"},
+	))
+	items := scrapeFixture(t, srv)
+
+	if len(items) != 1 {
+		t.Fatalf("got %d items, want only the one with a price", len(items))
+	}
+	if items[0].Price != "1000" {
+		t.Errorf("Price = %q, want the normalized decimal 1000", items[0].Price)
+	}
+}
+
+func TestMalformedPrices(t *testing.T) {
+	t.Run("scraped cards", func(t *testing.T) {
+		srv := newBoothServer(t, resultPage(
+			testCard{href: "https://booth.pm/ja/items/1", name: "壊れた価格", shop: "幻想郷サウンド", image: "https://booth.pximg.net/1.jpg", price: "1,000円"},
+			testCard{href: "https://booth.pm/ja/items/2", name: "幻想郷アレンジ集", shop: "幻想郷サウンド", image: "https://booth.pximg.net/2.jpg", price: "1000"},
+		))
+		items := scrapeFixture(t, srv)
+		if len(items) != 1 || items[0].Name != "幻想郷アレンジ集" {
+			t.Fatalf("got %d items, want only 幻想郷アレンジ集", len(items))
+		}
+	})
+
+	tests := []struct {
+		name          string
+		stored, price string
+	}{
+		{"scraped price", "1000", "abc"},
+		{"stored price", "abc", "1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := &Item{ID: 1, Price: tt.stored}
+			scraped := &Item{Price: tt.price}
+			// An error rather than a panic lets run skip just this item.
+			if _, err := decideItem(stored, scraped, NotifyParams{}); err == nil {
+				t.Error("decideItem() returned no error")
+			}
+		})
+	}
+}
+
+func TestShopLists(t *testing.T) {
+	t.Setenv("SHOP_BLOCKLIST", " Spam Shop ,ノイズ工房")
+	t.Setenv("SHOP_ALLOWLIST", "")
+	blocking, err := loadItemFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SHOP_BLOCKLIST", "")
+	t.Setenv("SHOP_ALLOWLIST", "幻想郷サウンド , Scarlet Keys")
+	allowing, err := loadItemFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter ItemFilter
+		shop   string
+		want   string
+	}{
+		{"blocked shop", blocking, "Spam Shop", "shop blocked"},
+		{"blocked shop, other case and spacing", blocking, " spam shop ", "shop blocked"},
+		{"blocked Japanese shop", blocking, "ノイズ工房", "shop blocked"},
+		{"unlisted shop with blocklist", blocking, "幻想郷サウンド", ""},
+		{"allowed shop", allowing, "幻想郷サウンド", ""},
+		{"allowed shop, other case", allowing, "scarlet keys", ""},
+		{"unlisted shop with allowlist", allowing, "Spam Shop", "shop not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := &Item{Name: "幻想郷アレンジ集", ShopName: tt.shop}
+			if got := tt.filter.skipReason(item); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	line := strings.Repeat("東", 120) + "\n"
+	tests := []struct {
+		name  string
+		msg   string
+		parts int
+	}{
+		{"short message", "【🆕新着情報🆕】\n\n幻想郷アレンジ集", 1},
+		{"many lines", strings.Repeat(line, 40), 3},
+		{"one oversized line", strings.Repeat("方", 4500), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMessage(tt.msg, discordMaxMessageLength)
+			if len(parts) != tt.parts {
+				t.Errorf("got %d parts, want %d", len(parts), tt.parts)
+			}
+			for i, p := range parts {
+				if n := utf8.RuneCountInString(p); n > discordMaxMessageLength {
+					t.Errorf("part %d has %d characters, over Discord's %d", i, n, discordMaxMessageLength)
+				}
+			}
+			if got := strings.Join(parts, ""); got != tt.msg {
+				t.Error("parts don't add up to the message")
+			}
+		})
+	}
+}
+
+func TestItemEmbedLimits(t *testing.T) {
+	item := &Item{
+		Name:        strings.Repeat("長", 3000),
+		URL:         "https://booth.pm/ja/items/1",
+		Price:       "1000",
+		ShopName:    strings.Repeat("店", 2000),
+		ShopURL:     "https://example.booth.pm/",
+		Category:    strings.Repeat("類", 3000),
+		Description: strings.Repeat("説", 5000),
+	}
+	e := itemEmbed(item)
+
+	if n := utf8.RuneCountInString(e.Title); n > discordMaxEmbedTitle {
+		t.Errorf("title has %d characters, over %d", n, discordMaxEmbedTitle)
+	}
+	for _, f := range e.Fields {
+		if n := utf8.RuneCountInString(f.Value); n > discordMaxFieldValue {
+			t.Errorf("field %s has %d characters, over %d", f.Name, n, discordMaxFieldValue)
+		}
+	}
+	if n := utf8.RuneCountInString(e.Footer.Text); n > discordMaxFooterText {
+		t.Errorf("footer has %d characters, over %d", n, discordMaxFooterText)
+	}
+	if n := embedLength(e); n > discordMaxEmbedTotal {
+		t.Errorf("embed has %d characters, over %d", n, discordMaxEmbedTotal)
+	}
+}
+
+func TestValidateItem(t *testing.T) {
+	valid := Item{
+		Name:     "幻想郷アレンジ集",
+		URL:      "https://booth.pm/ja/items/1",
+		Price:    "1000",
+		ImageURL: "https://booth.pximg.net/1.jpg",
+	}
+	tests := []struct {
+		name    string
+		modify  func(*Item)
+		wantErr string
+	}{
+		{"valid", func(*Item) {}, ""},
+		{"missing name", func(i *Item) { i.Name = "" }, "item has no name"},
+		{"blank name", func(i *Item) { i.Name = " \n" }, "item has no name"},
+		{"missing URL", func(i *Item) { i.URL = "" }, "item has no URL"},
+		{"missing price", func(i *Item) { i.Price = "" }, "item has no price"},
+		{"missing image URL", func(i *Item) { i.ImageURL = "" }, "item has no image URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := valid
+			tt.modify(&item)
+			err := validateItem(&item)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateItem() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validateItem() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLinkCardDescription(t *testing.T) {
+	pages := map[string]string{
+		"/meta": `<html><head><meta name="description" content=" 東方アレンジCD "></head></html>`,
+		"/both": `<html><head><meta property="og:description" content="og">` +
+			`<meta name="description" content="meta"></head></html>`,
+		"/og":   `<html><head><meta property="og:description" content="og"></head></html>`,
+		"/none": `<html><head></head></html>`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, pages[r.URL.Path])
+	}))
+	t.Cleanup(srv.Close)
+	itemPages.reset()
+	t.Cleanup(itemPages.reset)
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/meta", "東方アレンジCD"},
+		{"/both", "meta"},
+		{"/og", "og"},
+		{"/none", "幻想郷サウンド"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx := context.Background()
+			stored := &Item{URL: srv.URL + tt.path, ShopName: "幻想郷サウンド"}
+			// run fills a new item's description before posting; stored items may have none.
+			scraped := *stored
+			scraped.Description = fetchDescription(ctx, scraped.URL)
+			for name, item := range map[string]*Item{"stored": stored, "new": &scraped} {
+				post := &bsky.FeedPost{Embed: &bsky.FeedPost_Embed{}}
+				addLink(ctx, nil, post, item)
+				if got := post.Embed.EmbedExternal.External.Description; got != tt.want {
+					t.Errorf("%s item: link card description = %q, want %q", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecideItem(t *testing.T) {
+	stored := Item{
+		ID:       1,
+		Name:     "幻想郷アレンジ集",
+		Category: "音楽",
+		URL:      "https://booth.pm/ja/items/1",
+		Price:    "1000",
+		ImageURL: "https://booth.pximg.net/1.jpg",
+		Stock:    true,
+	}
+	tests := []struct {
+		name         string
+		storedID     int64
+		modify       func(*Item)
+		increases    bool
+		want         itemAction
+		priceChanged bool
+		stockChanged bool
+		imageChanged bool
+		changes      int
+		// wantUpdate and wantStock are substrings of the messages; "" means no message.
+		wantUpdate, wantStock string
+	}{
+		{name: "new item", storedID: 0, modify: func(*Item) {}, want: actionInsert},
+		{name: "unchanged", storedID: 1, modify: func(*Item) {}, want: actionNoOp},
+		{name: "same price at another scale", storedID: 1, modify: func(i *Item) { i.Price = "1000.0" }, want: actionNoOp},
+		{
+			name: "price drop", storedID: 1, modify: func(i *Item) { i.Price = "800" },
+			want: actionUpdate, priceChanged: true, wantUpdate: "📉-20%",
+		},
+		{
+			name: "price rise", storedID: 1, modify: func(i *Item) { i.Price = "1200" }, increases: true,
+			want: actionUpdate, priceChanged: true, wantUpdate: "📈+20%",
+		},
+		{
+			name: "price rise not announced", storedID: 1, modify: func(i *Item) { i.Price = "1200" },
+			want: actionUpdate, priceChanged: true,
+		},
+		{
+			name: "sold out", storedID: 1, modify: func(i *Item) { i.Stock = false },
+			want: actionUpdate, stockChanged: true, wantStock: "売り切れになりました",
+		},
+		{
+			name: "renamed", storedID: 1, modify: func(i *Item) { i.Name = "幻想郷アレンジ集 Vol.2" },
+			want: actionUpdate, changes: 1, wantUpdate: "タイトル: 幻想郷アレンジ集 -> 幻想郷アレンジ集 Vol.2",
+		},
+		{
+			name: "recategorized", storedID: 1, modify: func(i *Item) { i.Category = "同人誌" },
+			want: actionUpdate, changes: 1, wantUpdate: "カテゴリ: 音楽 -> 同人誌",
+		},
+		{
+			name: "new image", storedID: 1, modify: func(i *Item) { i.ImageURL = "https://booth.pximg.net/2.jpg" },
+			want: actionUpdate, imageChanged: true, changes: 1, wantUpdate: "画像が更新されました",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := stored
+			old.ID = tt.storedID
+			scraped := stored
+			scraped.ID = 0
+			tt.modify(&scraped)
+
+			d, err := decideItem(&old, &scraped, NotifyParams{notifyPriceIncreases: tt.increases})
+			if err != nil {
+				t.Fatalf("decideItem() error = %v", err)
+			}
+			if d.action != tt.want {
+				t.Errorf("action = %v, want %v", d.action, tt.want)
+			}
+			if d.priceChanged != tt.priceChanged || d.stockChanged != tt.stockChanged || d.imageChanged != tt.imageChanged {
+				t.Errorf("priceChanged, stockChanged, imageChanged = %v, %v, %v, want %v, %v, %v",
+					d.priceChanged, d.stockChanged, d.imageChanged, tt.priceChanged, tt.stockChanged, tt.imageChanged)
+			}
+			if len(d.changes) != tt.changes {
+				t.Errorf("changes = %q, want %d", d.changes, tt.changes)
+			}
+			if tt.wantUpdate == "" && d.updateMessage != "" {
+				t.Errorf("updateMessage = %q, want none", d.updateMessage)
+			} else if !strings.Contains(d.updateMessage, tt.wantUpdate) {
+				t.Errorf("updateMessage = %q, want it to contain %q", d.updateMessage, tt.wantUpdate)
+			}
+			if tt.wantStock == "" && d.stockMessage != "" {
+				t.Errorf("stockMessage = %q, want none", d.stockMessage)
+			} else if !strings.Contains(d.stockMessage, tt.wantStock) {
+				t.Errorf("stockMessage = %q, want it to contain %q", d.stockMessage, tt.wantStock)
+			}
+		})
+	}
+}
+
+func TestFormatPriceChange(t *testing.T) {
+	tests := []struct {
+		oldPrice, newPrice int64
+		want               string
+	}{
+		{1000, 800, "📉-20%"},
+		{1000, 1200, "📈+20%"},
+		{300, 200, "📉-33.3%"},
+		{300, 400, "📈+33.3%"},
+		{1000, 1000, "±0%"},
+		{0, 500, ""},
+	}
+	for _, tt := range tests {
+		got := formatPriceChange(decimal.NewFromInt(tt.oldPrice), decimal.NewFromInt(tt.newPrice))
+		if got != tt.want {
+			t.Errorf("formatPriceChange(%d, %d) = %q, want %q", tt.oldPrice, tt.newPrice, got, tt.want)
+		}
+	}
+}
+
+func TestFailedChannels(t *testing.T) {
+	ok, failed := true, false
+	p := NotifyParams{
+		tV2Cli:    &http.Client{},
+		dCli:      &discordgo.Session{},
+		channelID: "1",
+		bCli:      &blueskyClient{},
+	}
+	tests := []struct {
+		name                      string
+		twitter, discord, bluesky *bool
+		queued                    []string
+		want                      []string
+	}{
+		{"all delivered", &ok, &ok, &ok, nil, nil},
+		{"never attempted", nil, nil, nil, nil, nil},
+		{"one failed", &ok, &failed, &ok, nil, []string{"discord"}},
+		{"all failed", &failed, &failed, &failed, nil, []string{"twitter", "discord", "bluesky"}},
+		{"failed but queued", &failed, &failed, &ok, []string{"twitter"}, []string{"discord"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := &Item{NotifiedTwitter: tt.twitter, NotifiedDiscord: tt.discord, NotifiedBluesky: tt.bluesky}
+			rp, retry := failedChannels(p, item, tt.queued)
+			var got []string
+			if rp.tV2Cli != nil {
+				got = append(got, "twitter")
+			}
+			if rp.dCli != nil {
+				got = append(got, "discord")
+			}
+			if rp.bCli != nil {
+				got = append(got, "bluesky")
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("failedChannels() channels = %v, want %v", got, tt.want)
+			}
+			if retry != (len(tt.want) > 0) {
+				t.Errorf("failedChannels() ok = %v, want %v", retry, len(tt.want) > 0)
+			}
+		})
+	}
+}
+
+func TestMessageEmbed(t *testing.T) {
+	item := &Item{
+		Name:        "幻想郷アレンジ集",
+		URL:         "https://booth.pm/ja/items/1",
+		Price:       "800",
+		Description: "東方アレンジCD",
+	}
+	msg := "【🆙更新情報🆙】\n\n音楽\n幻想郷アレンジ集\n¥1,000 -> ¥800 (📉-20%)\n"
+	content, e := messageEmbed(msg, item)
+	if content != "【🆙更新情報🆙】" {
+		t.Errorf("content = %q, want the heading", content)
+	}
+	want := "音楽\n幻想郷アレンジ集\n¥1,000 -> ¥800 (📉-20%)\n\n東方アレンジCD"
+	if e.Description != want {
+		t.Errorf("description = %q, want %q", e.Description, want)
+	}
+
+	item.Name = strings.Repeat("長", 3000)
+	item.Category = strings.Repeat("類", 3000)
+	_, e = messageEmbed("見出し\n"+strings.Repeat("本", 5000), item)
+	if n := utf8.RuneCountInString(e.Description); n > discordMaxEmbedDesc {
+		t.Errorf("description has %d characters, over %d", n, discordMaxEmbedDesc)
+	}
+	if n := embedLength(e); n > discordMaxEmbedTotal {
+		t.Errorf("embed has %d characters, over %d", n, discordMaxEmbedTotal)
+	}
+}
+
+func TestSlackItemMessage(t *testing.T) {
+	item := &Item{
+		Name:     "幻想郷アレンジ集",
+		URL:      "https://booth.pm/ja/items/1",
+		Price:    "800",
+		ImageURL: "https://booth.pximg.net/1.jpg",
+	}
+	msg := "【在庫情報】\n\n音楽\n幻想郷アレンジ集\n売り切れになりました\n"
+	m := slackItemMessage(msg, item)
+	if m.Text != msg {
+		t.Errorf("text = %q, want %q", m.Text, msg)
+	}
+	if len(m.Blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(m.Blocks))
+	}
+	if got := m.Blocks[0].Text.Text; got != "【在庫情報】" {
+		t.Errorf("header = %q, want the heading", got)
+	}
+	want := "*<https://booth.pm/ja/items/1|幻想郷アレンジ集>*\n音楽\n幻想郷アレンジ集\n売り切れになりました"
+	if got := m.Blocks[1].Text.Text; got != want {
+		t.Errorf("section = %q, want %q", got, want)
+	}
+	if m.Blocks[1].Accessory == nil {
+		t.Error("section has no image")
+	}
+
+	m = slackItemMessage("【🆙更新情報🆙】\n¥1,000 -> ¥800", item)
+	if got := m.Blocks[1].Text.Text; !strings.HasSuffix(got, "¥1,000 -&gt; ¥800") {
+		t.Errorf("section = %q, want the price change escaped", got)
+	}
+}
+
+func TestConfigFileBools(t *testing.T) {
+	for _, k := range []string{"SEED", "DRY_RUN", "AUTO_MIGRATE"} {
+		t.Setenv(k, "")
+	}
+	name := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(name, []byte("SEED: false\nDRY_RUN: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(name); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"SEED", false},
+		{"DRY_RUN", true},
+		{"AUTO_MIGRATE", false},
+	}
+	for _, tt := range tests {
+		if got := getenvBool(tt.key, false); got != tt.want {
+			t.Errorf("getenvBool(%s) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
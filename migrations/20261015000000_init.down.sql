@@ -0,0 +1,7 @@
+-- The tables above may predate migrations/ and hold data this migration never
+-- created, so it can't be rolled back; undo later changes with new migrations.
+DO $$
+BEGIN
+    RAISE EXCEPTION 'the initial migration can not be rolled back';
+END
+$$;
@@ -0,0 +1,101 @@
+CREATE TABLE IF NOT EXISTS "public"."items" (
+    "id" bigserial NOT NULL,
+    "name" text NOT NULL,
+    "category" text NOT NULL DEFAULT ''::text,
+    "price" numeric NOT NULL,
+    "url" text NOT NULL,
+    "image_url" text NOT NULL,
+    "currency" text NOT NULL DEFAULT 'JPY'::text,
+    "shop_url" text NOT NULL DEFAULT ''::text,
+    "stock" boolean NOT NULL DEFAULT true,
+    "adult" boolean NOT NULL DEFAULT false,
+    "description" text NOT NULL DEFAULT ''::text,
+    "notified_twitter" boolean,
+    "notified_discord" boolean,
+    "notified_bluesky" boolean,
+    "published_at" timestamptz,
+    "created_at" timestamptz NOT NULL,
+    "updated_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+--bun:split
+
+-- Databases created before these columns existed get them here.
+ALTER TABLE "public"."items"
+    ADD COLUMN IF NOT EXISTS "category" text NOT NULL DEFAULT ''::text,
+    ADD COLUMN IF NOT EXISTS "currency" text NOT NULL DEFAULT 'JPY'::text,
+    ADD COLUMN IF NOT EXISTS "shop_url" text NOT NULL DEFAULT ''::text,
+    ADD COLUMN IF NOT EXISTS "stock" boolean NOT NULL DEFAULT true,
+    ADD COLUMN IF NOT EXISTS "adult" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "description" text NOT NULL DEFAULT ''::text,
+    ADD COLUMN IF NOT EXISTS "notified_twitter" boolean,
+    ADD COLUMN IF NOT EXISTS "notified_discord" boolean,
+    ADD COLUMN IF NOT EXISTS "notified_bluesky" boolean,
+    ADD COLUMN IF NOT EXISTS "published_at" timestamptz;
+
+--bun:split
+
+-- Concurrent runs may have stored a URL twice before the index existed; keep
+-- the first row of each.
+DELETE FROM "public"."items" AS "dup"
+    USING "public"."items" AS "kept"
+    WHERE "dup"."url" = "kept"."url" AND "dup"."id" > "kept"."id";
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "items_url_key" ON "public"."items" ("url");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "public"."price_histories" (
+    "id" bigserial NOT NULL,
+    "item_id" bigint NOT NULL,
+    "price" numeric NOT NULL,
+    "recorded_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("id")
+);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "public"."runs" (
+    "id" bigserial NOT NULL,
+    "started_at" timestamptz NOT NULL,
+    "finished_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "public"."notify_queue" (
+    "id" bigserial NOT NULL,
+    "channel" text NOT NULL,
+    "item_id" bigint NOT NULL,
+    "payload" text NOT NULL,
+    "attempts" bigint NOT NULL,
+    "next_retry_at" timestamptz NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("id")
+);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "public"."digests" (
+    "id" bigserial NOT NULL,
+    "posted_at" timestamptz NOT NULL,
+    "item_count" bigint NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "public"."bluesky_sessions" (
+    "identifier" text NOT NULL,
+    "did" text NOT NULL,
+    "handle" text NOT NULL,
+    "access_jwt" text NOT NULL,
+    "refresh_jwt" text NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "updated_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("identifier")
+);
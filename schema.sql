@@ -1,3 +1,5 @@
+-- The schema once every file in migrations/ is applied, for reference.
+-- Change it with a new migration and mirror the result here.
 CREATE TABLE "public"."items" (
     "id" bigserial NOT NULL,
     "name" text NOT NULL,
@@ -5,7 +7,62 @@ CREATE TABLE "public"."items" (
     "price" numeric NOT NULL,
     "url" text NOT NULL,
     "image_url" text NOT NULL,
+    "currency" text NOT NULL DEFAULT 'JPY'::text,
+    "shop_url" text NOT NULL DEFAULT ''::text,
+    "stock" boolean NOT NULL DEFAULT true,
+    "adult" boolean NOT NULL DEFAULT false,
+    "description" text NOT NULL DEFAULT ''::text,
+    "notified_twitter" boolean,
+    "notified_discord" boolean,
+    "notified_bluesky" boolean,
+    "published_at" timestamptz,
     "created_at" timestamptz NOT NULL,
     "updated_at" timestamptz NOT NULL,
     PRIMARY KEY ("id")
 );
+
+CREATE UNIQUE INDEX "items_url_key" ON "public"."items" ("url");
+
+CREATE TABLE "public"."price_histories" (
+    "id" bigserial NOT NULL,
+    "item_id" bigint NOT NULL,
+    "price" numeric NOT NULL,
+    "recorded_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE "public"."runs" (
+    "id" bigserial NOT NULL,
+    "started_at" timestamptz NOT NULL,
+    "finished_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE "public"."notify_queue" (
+    "id" bigserial NOT NULL,
+    "channel" text NOT NULL,
+    "item_id" bigint NOT NULL,
+    "payload" text NOT NULL,
+    "attempts" bigint NOT NULL,
+    "next_retry_at" timestamptz NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE "public"."digests" (
+    "id" bigserial NOT NULL,
+    "posted_at" timestamptz NOT NULL,
+    "item_count" bigint NOT NULL,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE "public"."bluesky_sessions" (
+    "identifier" text NOT NULL,
+    "did" text NOT NULL,
+    "handle" text NOT NULL,
+    "access_jwt" text NOT NULL,
+    "refresh_jwt" text NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "updated_at" timestamptz NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY ("identifier")
+);